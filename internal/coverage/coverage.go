@@ -0,0 +1,188 @@
+package coverage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mrxk/npv/pkg/npv"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const notIsolated = "NOT ISOLATED"
+
+// CoverageNamespaces reports the coverage of the pods in the given namespaces,
+// or in all namespaces when none are given. It also reports whether every
+// namespace and pod is isolated for the given categories.
+func CoverageNamespaces(
+	namespaces []string,
+	clientset kubernetes.Interface,
+	categories []string,
+	format string,
+) (string, bool, error) {
+	policies, err := npv.LoadNamespaces(context.Background(), clientset, namespaces)
+	if err != nil {
+		return "", false, err
+	}
+	workloads, err := npv.LoadWorkloads(context.Background(), clientset)
+	if err != nil {
+		return "", false, err
+	}
+	if len(namespaces) > 0 {
+		workloads = filter(workloads, namespaces)
+	}
+	return report(policies, workloads, categories, format)
+}
+
+// CoverageFiles reports the coverage of the pods and namespaces in the
+// workloads files by the policies in the policy files. It also reports whether
+// every namespace and pod is isolated for the given categories.
+func CoverageFiles(
+	files []npv.Manifest,
+	workloadFiles []npv.Manifest,
+	categories []string,
+	format string,
+	keepGoing bool,
+) (string, bool, error) {
+	check := npv.DecodeErrorHandler(os.Stderr, keepGoing)
+	objects, err := npv.DecodeManifests(files)
+	if err = check(err); err != nil {
+		return "", false, err
+	}
+	for _, policy := range objects.IgnoredPolicies() {
+		fmt.Fprintln(os.Stderr, "warning: ignoring "+policy+", coverage only reads NetworkPolicies")
+	}
+	policies, err := objects.NetworkPolicies()
+	if err = check(err); err != nil {
+		return "", false, err
+	}
+	workloadObjects, err := npv.DecodeManifests(workloadFiles)
+	if err = check(err); err != nil {
+		return "", false, err
+	}
+	workloads, err := workloadObjects.Workloads()
+	if err = check(err); err != nil {
+		return "", false, err
+	}
+	return report(policies, workloads, categories, format)
+}
+
+func filter(w *npv.Workloads, namespaces []string) *npv.Workloads {
+	filtered := &npv.Workloads{}
+	for _, pod := range w.Pods {
+		if slices.Contains(namespaces, pod.Namespace) {
+			filtered.Pods = append(filtered.Pods, pod)
+		}
+	}
+	for _, namespace := range w.Namespaces {
+		if slices.Contains(namespaces, namespace.Name) {
+			filtered.Namespaces = append(filtered.Namespaces, namespace)
+		}
+	}
+	return filtered
+}
+
+func report(
+	policies []networkingv1.NetworkPolicy,
+	workloads *npv.Workloads,
+	categories []string,
+	format string,
+) (string, bool, error) {
+	coverage := npv.NewCoverage(policies, workloads)
+	covered := isCovered(coverage, categories)
+	switch format {
+	case "", "text":
+		return text(coverage, categories), covered, nil
+	case "json":
+		content, err := json.MarshalIndent(coverage, "", "  ")
+		if err != nil {
+			return "", false, err
+		}
+		return string(content) + "\n", covered, nil
+	default:
+		return "", false, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+func isCovered(c *npv.Coverage, categories []string) bool {
+	for _, namespace := range c.Namespaces {
+		if !isolated(namespace.Ingress, namespace.Egress, categories) {
+			return false
+		}
+	}
+	for _, pod := range c.Pods {
+		if !isolated(pod.Ingress, pod.Egress, categories) {
+			return false
+		}
+	}
+	return true
+}
+
+func isolated(ingress, egress []string, categories []string) bool {
+	return (!slices.Contains(categories, "ingress") || len(ingress) > 0) &&
+		(!slices.Contains(categories, "egress") || len(egress) > 0)
+}
+
+// cells returns the isolating policies, or notIsolated, for the selected
+// categories.
+func cells(ingress, egress []string, categories []string) string {
+	values := []string{}
+	if slices.Contains(categories, "ingress") {
+		values = append(values, status(ingress))
+	}
+	if slices.Contains(categories, "egress") {
+		values = append(values, status(egress))
+	}
+	return strings.Join(values, "\t")
+}
+
+func status(policies []string) string {
+	if len(policies) == 0 {
+		return notIsolated
+	}
+	return strings.Join(policies, ", ")
+}
+
+func text(c *npv.Coverage, categories []string) string {
+	header := []string{}
+	for _, category := range categories {
+		header = append(header, strings.ToUpper(category))
+	}
+	b := bytes.Buffer{}
+	b.WriteString("Namespaces, isolated by policies selecting all of their pods:\n")
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\t"+strings.Join(header, "\t"))
+	for _, namespace := range c.Namespaces {
+		fmt.Fprintln(w, namespace.Name+"\t"+cells(namespace.Ingress, namespace.Egress, categories))
+	}
+	w.Flush()
+	b.WriteString("\n")
+	b.WriteString("Pods, isolated by policies selecting them:\n")
+	w = tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\t"+strings.Join(header, "\t"))
+	for _, pod := range c.Pods {
+		fmt.Fprintln(w, pod.Namespace+"\t"+pod.Name+"\t"+cells(pod.Ingress, pod.Egress, categories))
+	}
+	w.Flush()
+	b.WriteString("\n")
+	for _, category := range categories {
+		count := 0
+		for _, pod := range c.Pods {
+			policies := pod.Ingress
+			if category == "egress" {
+				policies = pod.Egress
+			}
+			if len(policies) == 0 {
+				count++
+			}
+		}
+		fmt.Fprintf(&b, "%d of %d pods are not isolated for %s\n", count, len(c.Pods), category)
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package coverage_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mrxk/npv/internal/coverage"
+	"github.com/mrxk/npv/pkg/npv"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+var tests = map[string]struct {
+	policies      []string
+	workloads     []string
+	categories    []string
+	namespace     []string
+	format        string
+	expected      string
+	expectedError string
+	covered       bool
+}{
+	"all": {
+		policies:   []string{"testdata/policies.input"},
+		workloads:  []string{"testdata/workloads.input"},
+		categories: []string{"ingress", "egress"},
+		expected:   "testdata/all.expected",
+	},
+	"ingressOnlyJSON": {
+		policies:   []string{"testdata/policies.input"},
+		workloads:  []string{"testdata/workloads.input"},
+		categories: []string{"ingress"},
+		format:     "json",
+		expected:   "testdata/all.ingress.json.expected",
+	},
+	"covered": {
+		policies:   []string{"testdata/policies.input"},
+		workloads:  []string{"testdata/covered.input"},
+		categories: []string{"ingress"},
+		expected:   "testdata/covered.ingress.expected",
+		covered:    true,
+	},
+	"unsupportedFormat": {
+		policies:      []string{"testdata/policies.input"},
+		workloads:     []string{"testdata/workloads.input"},
+		categories:    []string{"ingress", "egress"},
+		format:        "csv",
+		expectedError: "unsupported format: csv",
+	},
+}
+
+func TestCoverageNamespaces(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := createFakeClientset(t, append(tc.policies, tc.workloads...))
+			actual, covered, err := coverage.CoverageNamespaces(tc.namespace, clientset, tc.categories, tc.format)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+				require.Equal(t, tc.covered, covered)
+			}
+		})
+	}
+}
+
+func TestCoverageFiles(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, covered, err := coverage.CoverageFiles(readFiles(t, tc.policies), readFiles(t, tc.workloads), tc.categories, tc.format, false)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+				require.Equal(t, tc.covered, covered)
+			}
+		})
+	}
+}
+
+func TestCoverageNamespacesFilter(t *testing.T) {
+	clientset := createFakeClientset(t, []string{"testdata/policies.input", "testdata/workloads.input"})
+	actual, covered, err := coverage.CoverageNamespaces([]string{"shop"}, clientset, []string{"ingress"}, "")
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/shop.ingress.expected")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual, actual)
+	require.True(t, covered)
+}
+
+// readFiles reads the manifests in the files, expanding directories.
+func readFiles(t *testing.T, files []string) []npv.Manifest {
+	paths, err := npv.ExpandFiles(files, nil, nil)
+	require.NoError(t, err)
+	manifests, err := npv.ReadFiles(paths, nil)
+	require.NoError(t, err)
+	return manifests
+}
+
+// createFakeClientset creates a clientset holding every object in the files.
+// Lists are unwrapped.
+func createFakeClientset(t *testing.T, files []string) *fake.Clientset {
+	clientset := fake.NewClientset()
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj map[string]interface{}
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			addObject(t, clientset, &unstructured.Unstructured{Object: obj})
+		}
+	}
+	return clientset
+}
+
+func addObject(t *testing.T, clientset *fake.Clientset, obj *unstructured.Unstructured) {
+	if obj.IsList() {
+		require.NoError(t, obj.EachListItem(func(item runtime.Object) error {
+			addObject(t, clientset, item.(*unstructured.Unstructured))
+			return nil
+		}))
+		return
+	}
+	typed, err := scheme.Scheme.New(obj.GroupVersionKind())
+	require.NoError(t, err)
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, typed))
+	require.NoError(t, clientset.Tracker().Add(typed))
+}
@@ -0,0 +1,3 @@
+// Package coverage reports the namespaces and pods in files or in a Kubernetes
+// cluster that are not isolated by any network policy.
+package coverage
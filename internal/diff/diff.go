@@ -0,0 +1,123 @@
+package diff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/mrxk/npv/pkg/npv"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Source is one side of a diff: the manifests read from files and the
+// namespaces read from the cluster.
+type Source struct {
+	Manifests  []npv.Manifest
+	Namespaces []string
+}
+
+// ReadSources reads the files of the given sources. A source that is - or
+// matches at least one file or directory is read as files, with - read from
+// stdin, and any other source that is a valid namespace name is a namespace in
+// the cluster. Other sources, such as a path with a separator or an extension
+// that matches nothing, are an error. A directory holding a kustomization is
+// built, as kustomize build would, rather than read as files.
+func ReadSources(sources []string, stdin io.Reader) (Source, error) {
+	files := []npv.Manifest{}
+	namespaces := []string{}
+	for _, source := range sources {
+		paths := []string{source}
+		if source != npv.Stdin {
+			matches, err := filepath.Glob(source)
+			if err != nil {
+				return Source{}, err
+			}
+			if len(matches) == 0 {
+				if len(validation.IsDNS1123Label(source)) > 0 {
+					return Source{}, fmt.Errorf("cannot read %s: no such file or directory", source)
+				}
+				namespaces = append(namespaces, source)
+				continue
+			}
+			if len(matches) == 1 && npv.IsKustomization(matches[0]) {
+				built, err := npv.BuildKustomization(matches[0])
+				if err != nil {
+					return Source{}, err
+				}
+				files = append(files, built)
+				continue
+			}
+			paths, err = npv.ExpandFiles(paths, nil, nil)
+			if err != nil {
+				return Source{}, err
+			}
+		}
+		read, err := npv.ReadFiles(paths, stdin)
+		if err != nil {
+			return Source{}, err
+		}
+		files = append(files, read...)
+	}
+	return Source{Manifests: files, Namespaces: namespaces}, nil
+}
+
+// Diff compares the network policies of the old source with those of the new
+// source. The clientset is only requested when a namespace is read. With
+// keepGoing, documents of the manifests that cannot be decoded are reported on
+// stderr and skipped.
+func Diff(
+	old,
+	new Source,
+	clientset func() (kubernetes.Interface, error),
+	categories []string,
+	format string,
+	keepGoing bool,
+) (string, error) {
+	check := npv.DecodeErrorHandler(os.Stderr, keepGoing)
+	oldModel, err := load(old, clientset, check)
+	if err != nil {
+		return "", err
+	}
+	newModel, err := load(new, clientset, check)
+	if err != nil {
+		return "", err
+	}
+	return npv.NewDiff(oldModel, newModel).Render(format, npv.RenderOptions{
+		Ingress: slices.Contains(categories, "ingress"),
+		Egress:  slices.Contains(categories, "egress"),
+	})
+}
+
+func load(
+	source Source,
+	clientset func() (kubernetes.Interface, error),
+	check func(error) error,
+) (*npv.Model, error) {
+	objects, err := npv.DecodeManifests(source.Manifests)
+	if err = check(err); err != nil {
+		return nil, err
+	}
+	for _, policy := range objects.IgnoredPolicies() {
+		fmt.Fprintln(os.Stderr, "warning: ignoring "+policy+", diff only reads NetworkPolicies")
+	}
+	policies, err := objects.NetworkPolicies()
+	if err = check(err); err != nil {
+		return nil, err
+	}
+	if len(source.Namespaces) > 0 {
+		c, err := clientset()
+		if err != nil {
+			return nil, err
+		}
+		namespacePolicies, err := npv.LoadNamespaces(context.Background(), c, source.Namespaces)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, namespacePolicies...)
+	}
+	return npv.NewModel(policies)
+}
@@ -0,0 +1,166 @@
+package diff_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mrxk/npv/internal/diff"
+	"github.com/mrxk/npv/pkg/npv"
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var tests = map[string]struct {
+	old           string
+	new           string
+	categories    []string
+	format        string
+	expected      string
+	expectedError string
+}{
+	"text": {
+		old:        "testdata/old.input",
+		new:        "testdata/new.input",
+		categories: []string{"ingress", "egress"},
+		expected:   "testdata/text.expected",
+	},
+	"egressOnly": {
+		old:        "testdata/old.input",
+		new:        "testdata/new.input",
+		categories: []string{"egress"},
+		expected:   "testdata/egress.expected",
+	},
+	"noChanges": {
+		old:        "testdata/new.input",
+		new:        "testdata/new.input",
+		categories: []string{"ingress", "egress"},
+		expected:   "testdata/noChanges.expected",
+	},
+	"plantuml": {
+		old:        "testdata/old.input",
+		new:        "testdata/new.input",
+		categories: []string{"ingress", "egress"},
+		format:     "plantuml",
+		expected:   "testdata/plantuml.expected",
+	},
+	"dot": {
+		old:        "testdata/old.input",
+		new:        "testdata/new.input",
+		categories: []string{"ingress", "egress"},
+		format:     "dot",
+		expected:   "testdata/dot.expected",
+	},
+	"unsupportedFormat": {
+		old:           "testdata/old.input",
+		new:           "testdata/new.input",
+		categories:    []string{"ingress", "egress"},
+		format:        "mermaid",
+		expectedError: "unsupported format: mermaid",
+	},
+}
+
+func TestDiffFiles(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := func() (kubernetes.Interface, error) {
+				t.Fatal("unexpected clientset request")
+				return nil, nil
+			}
+			actual, err := diff.Diff(readSources(t, tc.old), readSources(t, tc.new), clientset, tc.categories, tc.format, false)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+			}
+		})
+	}
+}
+
+func TestDiffNamespaceToFiles(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := func() (kubernetes.Interface, error) {
+				return createFakeClientset(t, []string{tc.old}), nil
+			}
+			actual, err := diff.Diff(readSources(t, "default"), readSources(t, tc.new), clientset, tc.categories, tc.format, false)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+			}
+		})
+	}
+}
+
+func TestDiffKustomizations(t *testing.T) {
+	// Directories holding a kustomization are built rather than read as
+	// files.
+	clientset := func() (kubernetes.Interface, error) {
+		t.Fatal("unexpected clientset request")
+		return nil, nil
+	}
+	actual, err := diff.Diff(readSources(t, "../../pkg/npv/testdata/kustomize/base"), readSources(t, "../../pkg/npv/testdata/kustomize/overlays/prod"), clientset, []string{"ingress", "egress"}, "", false)
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/kustomize.expected")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual, actual)
+}
+
+func TestReadSources(t *testing.T) {
+	// Sources that match no file are namespaces, and - is read from stdin.
+	contents, err := os.ReadFile("testdata/old.input")
+	require.NoError(t, err)
+	source, err := diff.ReadSources([]string{"default", npv.Stdin, "testdata/new.input"}, bytes.NewReader(contents))
+	require.NoError(t, err)
+	require.Equal(t, []string{"default"}, source.Namespaces)
+	require.Len(t, source.Manifests, 2)
+	require.Equal(t, "<stdin>", source.Manifests[0].Name)
+	require.Equal(t, contents, source.Manifests[0].Contents)
+	require.Equal(t, "testdata/new.input", source.Manifests[1].Name)
+}
+
+func TestReadSourcesMissingFile(t *testing.T) {
+	// Sources that match no file and cannot be a namespace are an error.
+	for _, source := range []string{"testdata/missing.input", "missing.yaml", "policies/*.yaml"} {
+		_, err := diff.ReadSources([]string{source}, nil)
+		require.EqualError(t, err, "cannot read "+source+": no such file or directory")
+	}
+}
+
+// readSources reads the given sources without stdin.
+func readSources(t *testing.T, sources ...string) diff.Source {
+	source, err := diff.ReadSources(sources, nil)
+	require.NoError(t, err)
+	return source
+}
+
+func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj networkingv1.NetworkPolicy
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			objects = append(objects, &obj)
+		}
+	}
+	return fake.NewClientset(objects...)
+}
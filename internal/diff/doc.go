@@ -0,0 +1,3 @@
+// Package diff compares two sets of network policies read from files or from
+// a Kubernetes cluster.
+package diff
@@ -0,0 +1,3 @@
+// Package lint reports common mistakes in the network policies in files or in
+// a Kubernetes cluster.
+package lint
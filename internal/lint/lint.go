@@ -0,0 +1,89 @@
+package lint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mrxk/npv/pkg/npv"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LintNamespaces reports the findings in the policies of the given namespaces,
+// or of all namespaces when none are given. It also returns the highest
+// severity found, which is empty when there are no findings.
+func LintNamespaces(
+	namespaces []string,
+	clientset kubernetes.Interface,
+	format string,
+) (string, npv.Severity, error) {
+	policies, err := npv.LoadNamespaces(context.Background(), clientset, namespaces)
+	if err != nil {
+		return "", "", err
+	}
+	return report(policies, format)
+}
+
+// LintFiles reports the findings in the policies in the given files. It also
+// returns the highest severity found, which is empty when there are no
+// findings.
+func LintFiles(
+	files []npv.Manifest,
+	format string,
+	keepGoing bool,
+) (string, npv.Severity, error) {
+	check := npv.DecodeErrorHandler(os.Stderr, keepGoing)
+	objects, err := npv.DecodeManifests(files)
+	if err = check(err); err != nil {
+		return "", "", err
+	}
+	for _, policy := range objects.IgnoredPolicies() {
+		fmt.Fprintln(os.Stderr, "warning: ignoring "+policy+", lint only reads NetworkPolicies")
+	}
+	policies, err := objects.NetworkPolicies()
+	if err = check(err); err != nil {
+		return "", "", err
+	}
+	return report(policies, format)
+}
+
+func report(
+	policies []networkingv1.NetworkPolicy,
+	format string,
+) (string, npv.Severity, error) {
+	findings := npv.Lint(policies)
+	severity := npv.Severity("")
+	for _, f := range findings {
+		if f.Severity == npv.Error {
+			severity = npv.Error
+			break
+		}
+		severity = npv.Warning
+	}
+	switch format {
+	case "", "text":
+		return text(findings), severity, nil
+	case "json":
+		content, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return "", "", err
+		}
+		return string(content) + "\n", severity, nil
+	default:
+		return "", "", fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+func text(findings []npv.Finding) string {
+	b := strings.Builder{}
+	counts := map[npv.Severity]int{}
+	for _, f := range findings {
+		b.WriteString(f.String() + "\n")
+		counts[f.Severity]++
+	}
+	fmt.Fprintf(&b, "%d errors, %d warnings\n", counts[npv.Error], counts[npv.Warning])
+	return b.String()
+}
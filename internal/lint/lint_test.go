@@ -0,0 +1,129 @@
+package lint_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mrxk/npv/internal/lint"
+	"github.com/mrxk/npv/pkg/npv"
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var tests = map[string]struct {
+	policies         []string
+	namespace        []string
+	format           string
+	expected         string
+	expectedSeverity npv.Severity
+	expectedError    string
+}{
+	"problems": {
+		policies: []string{
+			"testdata/problems.input",
+		},
+		namespace:        []string{"default"},
+		expected:         "testdata/problems.expected",
+		expectedSeverity: npv.Error,
+	},
+	"problemsJSON": {
+		policies: []string{
+			"testdata/problems.input",
+		},
+		namespace:        []string{"default"},
+		format:           "json",
+		expected:         "testdata/problems.json.expected",
+		expectedSeverity: npv.Error,
+	},
+	"warnings": {
+		policies: []string{
+			"testdata/warnings.input",
+		},
+		namespace:        []string{"default"},
+		expected:         "testdata/warnings.expected",
+		expectedSeverity: npv.Warning,
+	},
+	"clean": {
+		policies: []string{
+			"testdata/clean.input",
+		},
+		namespace: []string{"default"},
+		expected:  "testdata/clean.expected",
+	},
+	"unsupportedFormat": {
+		policies: []string{
+			"testdata/clean.input",
+		},
+		namespace:     []string{"default"},
+		format:        "csv",
+		expectedError: "unsupported format: csv",
+	},
+}
+
+func TestLintNamespaces(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := createFakeClientset(t, tc.policies)
+			actual, severity, err := lint.LintNamespaces(tc.namespace, clientset, tc.format)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+				require.Equal(t, tc.expectedSeverity, severity)
+			}
+		})
+	}
+}
+
+func TestLintFiles(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, severity, err := lint.LintFiles(readFiles(t, tc.policies), tc.format, false)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+				require.Equal(t, tc.expectedSeverity, severity)
+			}
+		})
+	}
+}
+
+// readFiles reads the manifests in the files, expanding directories.
+func readFiles(t *testing.T, files []string) []npv.Manifest {
+	paths, err := npv.ExpandFiles(files, nil, nil)
+	require.NoError(t, err)
+	manifests, err := npv.ReadFiles(paths, nil)
+	require.NoError(t, err)
+	return manifests
+}
+
+func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj networkingv1.NetworkPolicy
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			objects = append(objects, &obj)
+		}
+	}
+	return fake.NewClientset(objects...)
+}
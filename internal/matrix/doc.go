@@ -0,0 +1,3 @@
+// Package matrix produces connectivity matrices of the network policies in
+// files or in a Kubernetes cluster.
+package matrix
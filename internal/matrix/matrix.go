@@ -0,0 +1,65 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/mrxk/npv/pkg/npv"
+	"k8s.io/client-go/kubernetes"
+)
+
+func MatrixNamespaces(
+	namespaces []string,
+	clientset kubernetes.Interface,
+	categories []string,
+	format string,
+) (string, error) {
+	policies, err := npv.LoadNamespaces(context.Background(), clientset, namespaces)
+	if err != nil {
+		return "", err
+	}
+	model, err := npv.NewModel(policies)
+	if err != nil {
+		return "", err
+	}
+	return render(model, categories, format)
+}
+
+func MatrixFiles(
+	files []npv.Manifest,
+	categories []string,
+	format string,
+	keepGoing bool,
+) (string, error) {
+	check := npv.DecodeErrorHandler(os.Stderr, keepGoing)
+	objects, err := npv.DecodeManifests(files)
+	if err = check(err); err != nil {
+		return "", err
+	}
+	for _, policy := range objects.IgnoredPolicies() {
+		fmt.Fprintln(os.Stderr, "warning: ignoring "+policy+", matrix only reads NetworkPolicies")
+	}
+	policies, err := objects.NetworkPolicies()
+	if err = check(err); err != nil {
+		return "", err
+	}
+	model, err := npv.NewModel(policies)
+	if err != nil {
+		return "", err
+	}
+	return render(model, categories, format)
+}
+
+func render(
+	model *npv.Model,
+	categories []string,
+	format string,
+) (string, error) {
+	matrix := npv.NewMatrix(model, npv.RenderOptions{
+		Ingress: slices.Contains(categories, "ingress"),
+		Egress:  slices.Contains(categories, "egress"),
+	})
+	return matrix.Render(format)
+}
@@ -0,0 +1,139 @@
+package matrix_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mrxk/npv/internal/matrix"
+	"github.com/mrxk/npv/pkg/npv"
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var tests = map[string]struct {
+	policies      []string
+	categories    []string
+	namespace     []string
+	format        string
+	expected      string
+	expectedError string
+}{
+	"allInOne": {
+		policies: []string{
+			"../visualize/testdata/allInOne.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/allInOne.expected",
+	},
+	"allInOneIngressOnlyCSV": {
+		policies: []string{
+			"../visualize/testdata/allInOne.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		format:     "csv",
+		expected:   "testdata/allInOne.ingress.csv.expected",
+	},
+	"multipleNamespacesMarkdown": {
+		policies: []string{
+			"../visualize/testdata/multipleNamespaces.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default", "one", "two"},
+		format:     "markdown",
+		expected:   "testdata/multipleNamespaces.markdown.expected",
+	},
+	"denyAllAndToPod": {
+		policies: []string{
+			"../visualize/testdata/denyAll.input",
+			"../visualize/testdata/denyToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/denyAllAndToPod.expected",
+	},
+	"multiplePeersWithoutPorts": {
+		policies: []string{
+			"testdata/multiplePeers.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/multiplePeers.expected",
+	},
+	"unsupportedFormat": {
+		policies: []string{
+			"../visualize/testdata/denyAll.input",
+		},
+		categories:    []string{"ingress", "egress"},
+		namespace:     []string{"default"},
+		format:        "plantuml",
+		expectedError: "unsupported format: plantuml",
+	},
+}
+
+func TestMatrixNamespaces(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := createFakeClientset(t, tc.policies)
+			actual, err := matrix.MatrixNamespaces(tc.namespace, clientset, tc.categories, tc.format)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+			}
+		})
+	}
+}
+
+func TestMatrixFiles(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := matrix.MatrixFiles(readFiles(t, tc.policies), tc.categories, tc.format, false)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+			}
+		})
+	}
+}
+
+// readFiles reads the manifests in the files, expanding directories.
+func readFiles(t *testing.T, files []string) []npv.Manifest {
+	paths, err := npv.ExpandFiles(files, nil, nil)
+	require.NoError(t, err)
+	manifests, err := npv.ReadFiles(paths, nil)
+	require.NoError(t, err)
+	return manifests
+}
+
+func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj networkingv1.NetworkPolicy
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			objects = append(objects, &obj)
+		}
+	}
+	return fake.NewClientset(objects...)
+}
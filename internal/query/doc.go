@@ -0,0 +1,3 @@
+// Package query reports whether the network policies in files or in a
+// Kubernetes cluster allow a connection between two endpoints.
+package query
@@ -0,0 +1,149 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mrxk/npv/pkg/npv"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+func QueryNamespaces(
+	namespaces []string,
+	clientset kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	from string,
+	to string,
+	port string,
+) (string, error) {
+	source, destination, p, err := parse(from, to, port)
+	if err != nil {
+		return "", err
+	}
+	policies, err := npv.LoadNamespaces(context.Background(), clientset, namespaces)
+	if err != nil {
+		return "", err
+	}
+	adminPolicies, err := npv.LoadAdminPolicies(context.Background(), dynamicClient)
+	if err != nil {
+		return "", err
+	}
+	// Namespace selectors match the labels of the namespace so fetch them
+	// from the cluster.
+	for _, e := range []*npv.Endpoint{&source, &destination} {
+		if !e.IsPod() {
+			continue
+		}
+		namespace, err := clientset.CoreV1().Namespaces().Get(context.Background(), e.Namespace, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("cannot read namespace of endpoint %s: %w", e, err)
+		}
+		e.NamespaceLabels = namespace.Labels
+	}
+	return evaluate(adminPolicies, policies, source, destination, p), nil
+}
+
+func QueryFiles(
+	files []npv.Manifest,
+	from string,
+	to string,
+	port string,
+	keepGoing bool,
+) (string, error) {
+	source, destination, p, err := parse(from, to, port)
+	if err != nil {
+		return "", err
+	}
+	check := npv.DecodeErrorHandler(os.Stderr, keepGoing)
+	objects, err := npv.DecodeManifests(files)
+	if err = check(err); err != nil {
+		return "", err
+	}
+	for _, policy := range objects.IgnoredPolicies(npv.AdminNetworkPolicyKind, npv.BaselineAdminNetworkPolicyKind) {
+		fmt.Fprintln(os.Stderr, "warning: ignoring "+policy+", query only reads NetworkPolicies and admin network policies")
+	}
+	policies, err := objects.NetworkPolicies()
+	if err = check(err); err != nil {
+		return "", err
+	}
+	adminPolicies, err := objects.AdminPolicies()
+	if err = check(err); err != nil {
+		return "", err
+	}
+	return evaluate(adminPolicies, policies, source, destination, p), nil
+}
+
+func parse(from, to, port string) (npv.Endpoint, npv.Endpoint, npv.Port, error) {
+	source, err := npv.ParseEndpoint(from)
+	if err != nil {
+		return npv.Endpoint{}, npv.Endpoint{}, npv.Port{}, err
+	}
+	destination, err := npv.ParseEndpoint(to)
+	if err != nil {
+		return npv.Endpoint{}, npv.Endpoint{}, npv.Port{}, err
+	}
+	p, err := npv.ParsePort(port)
+	if err != nil {
+		return npv.Endpoint{}, npv.Endpoint{}, npv.Port{}, err
+	}
+	return source, destination, p, nil
+}
+
+func evaluate(
+	adminPolicies []npv.AdminNetworkPolicy,
+	policies []networkingv1.NetworkPolicy,
+	from npv.Endpoint,
+	to npv.Endpoint,
+	port npv.Port,
+) string {
+	v := npv.EvaluateWithAdminPolicies(adminPolicies, policies, from, to, port)
+	b := strings.Builder{}
+	if v.Allowed {
+		b.WriteString("ALLOWED\n")
+	} else {
+		b.WriteString("DENIED\n")
+	}
+	b.WriteString("Egress from " + from.String() + " to " + to.String() + " on " + port.String() + ": ")
+	b.WriteString(describe(v.Egress, from, "egress"))
+	b.WriteString("Ingress to " + to.String() + " from " + from.String() + " on " + port.String() + ": ")
+	b.WriteString(describe(v.Ingress, to, "ingress"))
+	return b.String()
+}
+
+func describe(d npv.Decision, e npv.Endpoint, direction string) string {
+	b := strings.Builder{}
+	passed := ""
+	if d.Passed != nil {
+		passed = "    Passed by: " + d.Passed.String() + "\n"
+	}
+	switch {
+	case !e.IsPod():
+		b.WriteString("allowed (not a pod)\n")
+		return b.String()
+	case d.AdminRule != nil && d.Allowed:
+		b.WriteString("allowed\n" + passed)
+		b.WriteString("    Allowed by: " + d.AdminRule.String() + "\n")
+		return b.String()
+	case d.AdminRule != nil:
+		b.WriteString("denied\n" + passed)
+		b.WriteString("    Denied by: " + d.AdminRule.String() + "\n")
+		return b.String()
+	case !d.Isolated:
+		b.WriteString("allowed (no policy selects the pod for " + direction + ")\n" + passed)
+		return b.String()
+	case d.Allowed:
+		b.WriteString("allowed\n" + passed)
+	default:
+		b.WriteString("denied (no rule allows the connection)\n" + passed)
+	}
+	b.WriteString("    Selected by: " + strings.Join(d.Policies, ", ") + "\n")
+	for _, rule := range d.Rules {
+		b.WriteString("    Allowed by: " + rule.String() + "\n")
+	}
+	return b.String()
+}
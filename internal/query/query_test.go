@@ -0,0 +1,288 @@
+package query_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mrxk/npv/internal/query"
+	"github.com/mrxk/npv/pkg/npv"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var tests = map[string]struct {
+	policies      []string
+	from          string
+	to            string
+	port          string
+	expected      string
+	expectedError string
+	// namespacesError is the error expected from QueryNamespaces when it
+	// differs from that of QueryFiles, which does not read namespaces.
+	namespacesError string
+}{
+	"allowedBothWays": {
+		policies: []string{"testdata/policies.input"},
+		from:     "shop/app=web",
+		to:       "shop/app=db",
+		port:     "5432/TCP",
+		expected: `ALLOWED
+Egress from shop/app=web to shop/app=db on 5432/TCP: allowed
+    Selected by: shop/default-deny, shop/web
+    Allowed by: shop/web egress rule 0
+Ingress to shop/app=db from shop/app=web on 5432/TCP: allowed
+    Selected by: shop/db, shop/default-deny
+    Allowed by: shop/db ingress rule 0
+`,
+	},
+	"wrongPort": {
+		policies: []string{"testdata/policies.input"},
+		from:     "shop/app=web",
+		to:       "shop/app=db",
+		port:     "5433",
+		expected: `DENIED
+Egress from shop/app=web to shop/app=db on 5433/TCP: denied (no rule allows the connection)
+    Selected by: shop/default-deny, shop/web
+Ingress to shop/app=db from shop/app=web on 5433/TCP: denied (no rule allows the connection)
+    Selected by: shop/db, shop/default-deny
+`,
+	},
+	"wrongProtocol": {
+		policies: []string{"testdata/policies.input"},
+		from:     "shop/app=web",
+		to:       "shop/app=db",
+		port:     "5432/UDP",
+		expected: `DENIED
+Egress from shop/app=web to shop/app=db on 5432/UDP: denied (no rule allows the connection)
+    Selected by: shop/default-deny, shop/web
+Ingress to shop/app=db from shop/app=web on 5432/UDP: denied (no rule allows the connection)
+    Selected by: shop/db, shop/default-deny
+`,
+	},
+	"notIsolatedSource": {
+		policies: []string{"testdata/policies.input"},
+		from:     "monitoring/app=prometheus",
+		to:       "shop/app=db",
+		port:     "9050",
+		expected: `ALLOWED
+Egress from monitoring/app=prometheus to shop/app=db on 9050/TCP: allowed (no policy selects the pod for egress)
+Ingress to shop/app=db from monitoring/app=prometheus on 9050/TCP: allowed
+    Selected by: shop/db, shop/default-deny
+    Allowed by: shop/db ingress rule 1
+`,
+	},
+	"portOutsideRange": {
+		policies: []string{"testdata/policies.input"},
+		from:     "monitoring/app=prometheus",
+		to:       "shop/app=db",
+		port:     "9101",
+		expected: `DENIED
+Egress from monitoring/app=prometheus to shop/app=db on 9101/TCP: allowed (no policy selects the pod for egress)
+Ingress to shop/app=db from monitoring/app=prometheus on 9101/TCP: denied (no rule allows the connection)
+    Selected by: shop/db, shop/default-deny
+`,
+	},
+	"externalAddress": {
+		policies: []string{"testdata/policies.input"},
+		from:     "shop/app=web",
+		to:       "192.0.2.1",
+		port:     "443",
+		expected: `ALLOWED
+Egress from shop/app=web to 192.0.2.1 on 443/TCP: allowed
+    Selected by: shop/default-deny, shop/web
+    Allowed by: shop/web egress rule 1
+Ingress to 192.0.2.1 from shop/app=web on 443/TCP: allowed (not a pod)
+`,
+	},
+	"exceptedAddress": {
+		policies: []string{"testdata/policies.input"},
+		from:     "shop/app=web",
+		to:       "10.1.2.3",
+		port:     "443",
+		expected: `DENIED
+Egress from shop/app=web to 10.1.2.3 on 443/TCP: denied (no rule allows the connection)
+    Selected by: shop/default-deny, shop/web
+Ingress to 10.1.2.3 from shop/app=web on 443/TCP: allowed (not a pod)
+`,
+	},
+	"adminAllow": {
+		policies: []string{"testdata/policies.input", "testdata/admin.input"},
+		from:     "monitoring/app=prometheus",
+		to:       "shop/app=db",
+		port:     "9101",
+		expected: `ALLOWED
+Egress from monitoring/app=prometheus to shop/app=db on 9101/TCP: allowed (no policy selects the pod for egress)
+Ingress to shop/app=db from monitoring/app=prometheus on 9101/TCP: allowed
+    Allowed by: AdminNetworkPolicy/platform ingress rule 0
+`,
+	},
+	"adminDeny": {
+		policies: []string{"testdata/policies.input", "testdata/admin.input"},
+		from:     "shop/app=web",
+		to:       "169.254.169.254",
+		port:     "443",
+		expected: `DENIED
+Egress from shop/app=web to 169.254.169.254 on 443/TCP: denied
+    Denied by: AdminNetworkPolicy/platform egress rule 0
+Ingress to 169.254.169.254 from shop/app=web on 443/TCP: allowed (not a pod)
+`,
+	},
+	"adminPass": {
+		policies: []string{"testdata/policies.input", "testdata/admin.input"},
+		from:     "shop/app=web",
+		to:       "shop/app=db",
+		port:     "5432/TCP",
+		expected: `ALLOWED
+Egress from shop/app=web to shop/app=db on 5432/TCP: allowed
+    Passed by: AdminNetworkPolicy/platform egress rule 1
+    Selected by: shop/default-deny, shop/web
+    Allowed by: shop/web egress rule 0
+Ingress to shop/app=db from shop/app=web on 5432/TCP: allowed
+    Selected by: shop/db, shop/default-deny
+    Allowed by: shop/db ingress rule 0
+`,
+	},
+	"baselineDeny": {
+		policies: []string{"testdata/policies.input", "testdata/admin.input"},
+		from:     "monitoring/app=prometheus",
+		to:       "monitoring/app=grafana",
+		port:     "3000",
+		expected: `DENIED
+Egress from monitoring/app=prometheus to monitoring/app=grafana on 3000/TCP: allowed (no policy selects the pod for egress)
+Ingress to monitoring/app=grafana from monitoring/app=prometheus on 3000/TCP: denied
+    Denied by: BaselineAdminNetworkPolicy/default ingress rule 0
+`,
+	},
+	"invalidEndpoint": {
+		policies:      []string{"testdata/policies.input"},
+		from:          "app=web",
+		to:            "shop/app=db",
+		port:          "5432",
+		expectedError: "invalid endpoint \"app=web\"",
+	},
+	"invalidNamespace": {
+		policies: []string{"testdata/policies.input"},
+		from:     "missing/app=web",
+		to:       "shop/app=db",
+		port:     "5432",
+		expected: `DENIED
+Egress from missing/app=web to shop/app=db on 5432/TCP: allowed (no policy selects the pod for egress)
+Ingress to shop/app=db from missing/app=web on 5432/TCP: denied (no rule allows the connection)
+    Selected by: shop/db, shop/default-deny
+`,
+		namespacesError: "cannot read namespace of endpoint missing/app=web: namespaces \"missing\" not found",
+	},
+	"invalidPort": {
+		policies:      []string{"testdata/policies.input"},
+		from:          "shop/app=web",
+		to:            "shop/app=db",
+		port:          "5432/ICMP",
+		expectedError: "unsupported protocol ICMP",
+	},
+}
+
+func TestQueryNamespaces(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := createFakeClientset(t, tc.policies)
+			dynamicClient := createFakeDynamicClient(t, tc.policies)
+			actual, err := query.QueryNamespaces(nil, clientset, dynamicClient, tc.from, tc.to, tc.port)
+			if tc.namespacesError != "" {
+				require.EqualError(t, err, tc.namespacesError)
+			} else if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, actual, actual)
+			}
+		})
+	}
+}
+
+func TestQueryFiles(t *testing.T) {
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := query.QueryFiles(readFiles(t, tc.policies), tc.from, tc.to, tc.port, false)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, actual, actual)
+			}
+		})
+	}
+}
+
+// readFiles reads the manifests in the files, expanding directories.
+func readFiles(t *testing.T, files []string) []npv.Manifest {
+	paths, err := npv.ExpandFiles(files, nil, nil)
+	require.NoError(t, err)
+	manifests, err := npv.ReadFiles(paths, nil)
+	require.NoError(t, err)
+	return manifests
+}
+
+func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
+	objects := []runtime.Object{}
+	for _, name := range []string{"shop", "monitoring"} {
+		objects = append(objects, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{corev1.LabelMetadataName: name},
+			},
+		})
+	}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj networkingv1.NetworkPolicy
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if obj.Kind != "NetworkPolicy" || obj.GroupVersionKind().Group != networkingv1.GroupName {
+				continue
+			}
+			objects = append(objects, &obj)
+		}
+	}
+	return fake.NewClientset(objects...)
+}
+
+func createFakeDynamicClient(t *testing.T, policies []string) *dynamicfake.FakeDynamicClient {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj map[string]interface{}
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			u := &unstructured.Unstructured{Object: obj}
+			if u.GroupVersionKind().Group == npv.AdminNetworkPolicies.Group {
+				objects = append(objects, u)
+			}
+		}
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		npv.AdminNetworkPolicies:         "AdminNetworkPolicyList",
+		npv.BaselineAdminNetworkPolicies: "BaselineAdminNetworkPolicyList",
+	}, objects...)
+}
@@ -0,0 +1,3 @@
+// Package serve serves the diagrams of the network policies in a Kubernetes
+// cluster over HTTP using the renderers provided by package npv.
+package serve
@@ -0,0 +1,205 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrxk/npv/pkg/npv"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+)
+
+// contentTypes are the content types of the formats. Other formats are
+// served as plain text.
+var contentTypes = map[string]string{
+	"json": "application/json",
+	"svg":  "image/svg+xml",
+	"html": "text/html; charset=utf-8",
+}
+
+// formats are the formats linked from the index.
+var formats = []string{"plantuml", "dot", "mermaid", "json", "svg", "html"}
+
+var index = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>npv</title></head>
+<body>
+<h1>Network Policies</h1>
+<ul>
+<li>All namespaces:{{range $.Formats}} <a href="diagram?format={{.}}">{{.}}</a>{{end}}</li>
+{{- range .Namespaces}}
+<li>{{.}}:{{$namespace := .}}{{range $.Formats}} <a href="namespaces/{{$namespace}}?format={{.}}">{{.}}</a>{{end}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// Server serves the diagrams of the NetworkPolicies in a cluster over HTTP.
+// The policies are read from the cache of informers so that requests do not
+// reach the API server. It serves:
+//
+//   - / with links to the diagram of every namespace with policies
+//   - /diagram with the policies of every namespace, or of those given by
+//     namespace query parameters
+//   - /namespaces/{namespace} with the policies of one namespace
+//
+// Diagrams take the format (plantuml by default), ingress-only, egress-only
+// and linetype query parameters.
+type Server struct {
+	listers []networkinglisters.NetworkPolicyLister
+	mux     *http.ServeMux
+}
+
+// NewServer starts informers on the NetworkPolicies of the given namespaces,
+// or of every namespace when none are given, and returns a server once they
+// have listed the existing policies. The informers stop when ctx is done.
+func NewServer(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	namespaces []string,
+) (*Server, error) {
+	s := &Server{mux: http.NewServeMux()}
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+		s.listers = append(s.listers, factory.Networking().V1().NetworkPolicies().Lister())
+		factory.Start(ctx.Done())
+		for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return nil, fmt.Errorf("cannot watch %s in namespace %q", informerType, namespace)
+			}
+		}
+	}
+	s.mux.HandleFunc("GET /{$}", s.serveIndex)
+	s.mux.HandleFunc("GET /diagram", s.serveDiagram)
+	s.mux.HandleFunc("GET /namespaces/{namespace}", s.serveDiagram)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	policies, err := s.policies(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	namespaces := []string{}
+	for _, policy := range policies {
+		if !slices.Contains(namespaces, policy.Namespace) {
+			namespaces = append(namespaces, policy.Namespace)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = index.Execute(w, struct {
+		Namespaces []string
+		Formats    []string
+	}{namespaces, formats})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) serveDiagram(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	namespaces := []string{}
+	if namespace := r.PathValue("namespace"); namespace != "" {
+		namespaces = append(namespaces, namespace)
+	} else {
+		for _, value := range query["namespace"] {
+			namespaces = append(namespaces, strings.Split(value, ",")...)
+		}
+	}
+	ingressOnly, err := flag(query.Get("ingress-only"), query.Has("ingress-only"))
+	if err != nil {
+		http.Error(w, "ingress-only: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	egressOnly, err := flag(query.Get("egress-only"), query.Has("egress-only"))
+	if err != nil {
+		http.Error(w, "egress-only: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ingressOnly && egressOnly {
+		http.Error(w, "ingress-only and egress-only cannot both be set", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	renderer, err := npv.RendererFor(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policies, err := s.policies(namespaces)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	model, err := npv.NewModel(policies)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content, err := renderer.Render(model, npv.RenderOptions{
+		Ingress:  !egressOnly,
+		Egress:   !ingressOnly,
+		Linetype: query.Get("linetype"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contentType, present := contentTypes[format]
+	if !present {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	fmt.Fprintln(w, content)
+}
+
+// policies returns copies of the cached policies of the given namespaces, or
+// of every namespace when none are given, sorted by namespace and name.
+func (s *Server) policies(namespaces []string) ([]networkingv1.NetworkPolicy, error) {
+	policies := []networkingv1.NetworkPolicy{}
+	for _, lister := range s.listers {
+		cached, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, policy := range cached {
+			if len(namespaces) == 0 || slices.Contains(namespaces, policy.Namespace) {
+				policies = append(policies, *policy.DeepCopy())
+			}
+		}
+	}
+	slices.SortFunc(policies, func(a, b networkingv1.NetworkPolicy) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+	return policies, nil
+}
+
+// flag parses a boolean query parameter, which is true when present without
+// a value.
+func flag(value string, present bool) (bool, error) {
+	if !present {
+		return false, nil
+	}
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
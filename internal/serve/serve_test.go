@@ -0,0 +1,150 @@
+package serve_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mrxk/npv/internal/serve"
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var tests = map[string]struct {
+	path          string
+	status        int
+	contentType   string
+	expected      string
+	expectedError string
+}{
+	"namespace": {
+		path:        "/namespaces/two?format=json",
+		status:      http.StatusOK,
+		contentType: "application/json",
+		expected:    "testdata/two.json.expected",
+	},
+	"namespaceFilter": {
+		path:        "/diagram?namespace=one,two&ingress-only",
+		status:      http.StatusOK,
+		contentType: "text/plain; charset=utf-8",
+		expected:    "testdata/oneAndTwo.ingress.expected",
+	},
+	"namespaceParameters": {
+		path:        "/diagram?namespace=one&namespace=two&ingress-only=true",
+		status:      http.StatusOK,
+		contentType: "text/plain; charset=utf-8",
+		expected:    "testdata/oneAndTwo.ingress.expected",
+	},
+	"allNamespaces": {
+		path:        "/diagram?format=dot",
+		status:      http.StatusOK,
+		contentType: "text/plain; charset=utf-8",
+		expected:    "testdata/multipleNamespaces.dot.expected",
+	},
+	"unsupportedFormat": {
+		path:          "/diagram?format=png",
+		status:        http.StatusBadRequest,
+		expectedError: "unsupported format: png",
+	},
+	"exclusiveCategories": {
+		path:          "/diagram?ingress-only&egress-only",
+		status:        http.StatusBadRequest,
+		expectedError: "ingress-only and egress-only cannot both be set",
+	},
+	"invalidFlag": {
+		path:          "/diagram?egress-only=maybe",
+		status:        http.StatusBadRequest,
+		expectedError: "egress-only: ",
+	},
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := serve.NewServer(ctx, createFakeClientset(t, []string{"../visualize/testdata/multipleNamespaces.input"}), nil)
+	require.NoError(t, err)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			status, contentType, actual := get(t, server, tc.path)
+			require.Equal(t, tc.status, status, actual)
+			if tc.expectedError != "" {
+				require.Contains(t, actual, tc.expectedError)
+			} else {
+				require.Equal(t, tc.contentType, contentType)
+				expected, err := os.ReadFile(tc.expected)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), actual, actual)
+			}
+		})
+	}
+}
+
+func TestServerIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := serve.NewServer(ctx, createFakeClientset(t, []string{"../visualize/testdata/multipleNamespaces.input"}), nil)
+	require.NoError(t, err)
+	status, contentType, actual := get(t, server, "/")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "text/html; charset=utf-8", contentType)
+	require.Contains(t, actual, `<a href="diagram?format=svg">svg</a>`)
+	for _, namespace := range []string{"default", "one", "two"} {
+		require.Contains(t, actual, `<a href="namespaces/`+namespace+`?format=plantuml">plantuml</a>`)
+	}
+	status, _, _ = get(t, server, "/missing")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerFollowsChanges(t *testing.T) {
+	clientset := createFakeClientset(t, []string{"../visualize/testdata/multipleNamespaces.input"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Only the policies of the given namespaces are cached.
+	server, err := serve.NewServer(ctx, clientset, []string{"three"})
+	require.NoError(t, err)
+	_, _, actual := get(t, server, "/diagram?format=json")
+	require.NotContains(t, actual, `"namespace": "two"`)
+	policy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "three"}}
+	_, err = clientset.NetworkingV1().NetworkPolicies("three").Create(ctx, policy, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, _, actual := get(t, server, "/namespaces/three?format=json")
+		return bytes.Contains([]byte(actual), []byte(`"new"`))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func get(t *testing.T, handler http.Handler, path string) (int, string, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	return recorder.Code, recorder.Header().Get("Content-Type"), string(body)
+}
+
+func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj networkingv1.NetworkPolicy
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			objects = append(objects, &obj)
+		}
+	}
+	return fake.NewClientset(objects...)
+}
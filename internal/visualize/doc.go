@@ -1,3 +1,3 @@
-// Package visualize produces PlantUML diagrams of network policies in a
-// Kubernetes cluseter.
+// Package visualize renders the network policies in files or in a Kubernetes
+// cluster using the renderers provided by package npv.
 package visualize
@@ -2,16 +2,26 @@ package visualize_test
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mrxk/npv/internal/visualize"
+	"github.com/mrxk/npv/pkg/npv"
 	"github.com/stretchr/testify/require"
 	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
 )
 
 var tests = map[string]struct {
@@ -21,6 +31,9 @@ var tests = map[string]struct {
 	expected      string
 	expectedError string
 	fileOnly      bool
+	format        string
+	istio         bool
+	keepGoing     bool
 }{
 	"one": {
 		policies: []string{
@@ -103,6 +116,23 @@ var tests = map[string]struct {
 		namespace:  []string{"default", "one", "two"},
 		expected:   "testdata/multipleNamespaces.expected",
 	},
+	"inferredPolicyTypes": {
+		policies: []string{
+			"testdata/inferredPolicyTypes.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/inferredPolicyTypes.expected",
+	},
+	"inferredPolicyTypesJSON": {
+		policies: []string{
+			"testdata/inferredPolicyTypes.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/inferredPolicyTypes.json.expected",
+	},
 	"noName": {
 		fileOnly: true,
 		policies: []string{
@@ -112,6 +142,350 @@ var tests = map[string]struct {
 		namespace:  []string{"default"},
 		expected:   "testdata/noName.expected",
 	},
+	"malformed": {
+		fileOnly: true,
+		policies: []string{
+			"testdata/malformed.input",
+		},
+		categories:    []string{"ingress", "egress"},
+		namespace:     []string{"default"},
+		expectedError: "testdata/malformed.input: document 2, line 37: ",
+	},
+	"malformedKeepGoing": {
+		fileOnly: true,
+		policies: []string{
+			"testdata/malformed.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		keepGoing:  true,
+		expected:   "testdata/allowToPod.expected",
+	},
+	"oneDOT": {
+		policies: []string{
+			"testdata/allowToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		expected:   "testdata/allowToPod.dot.expected",
+	},
+	"denyAllAndToPodDOT": {
+		policies: []string{
+			"testdata/denyAll.input",
+			"testdata/denyToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		expected:   "testdata/denyAllAndToPod.dot.expected",
+	},
+	"allInOneDOT": {
+		policies: []string{
+			"testdata/allInOne.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		expected:   "testdata/allInOne.dot.expected",
+	},
+	"oneMermaid": {
+		policies: []string{
+			"testdata/allowToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "mermaid",
+		expected:   "testdata/allowToPod.mermaid.expected",
+	},
+	"denyAllAndToPodMermaid": {
+		policies: []string{
+			"testdata/denyAll.input",
+			"testdata/denyToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "mermaid",
+		expected:   "testdata/denyAllAndToPod.mermaid.expected",
+	},
+	"allInOneMermaid": {
+		policies: []string{
+			"testdata/allInOne.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "mermaid",
+		expected:   "testdata/allInOne.mermaid.expected",
+	},
+	"oneJSON": {
+		policies: []string{
+			"testdata/allowToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/allowToPod.json.expected",
+	},
+	"oneEgressOnlyJSON": {
+		policies: []string{
+			"testdata/allowToPod.input",
+		},
+		categories: []string{"egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/allowToPod.egress.json.expected",
+	},
+	"denyAllAndToPodJSON": {
+		policies: []string{
+			"testdata/denyAll.input",
+			"testdata/denyToPod.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/denyAllAndToPod.json.expected",
+	},
+	"allInOneJSON": {
+		policies: []string{
+			"testdata/allInOne.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/allInOne.json.expected",
+	},
+	"allInOneHTML": {
+		policies: []string{
+			"testdata/allInOne.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "html",
+		expected:   "testdata/allInOne.html.expected",
+	},
+	"denyAllAndToPodIngressOnlyHTML": {
+		policies: []string{
+			"testdata/denyAll.input",
+			"testdata/denyToPod.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		format:     "html",
+		expected:   "testdata/denyAllAndToPod.ingress.html.expected",
+	},
+	"allInOneSVG": {
+		policies: []string{
+			"testdata/allInOne.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "svg",
+		expected:   "testdata/allInOne.svg.expected",
+	},
+	"multipleNamespacesSVG": {
+		policies: []string{
+			"testdata/multipleNamespaces.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default", "one", "two"},
+		format:     "svg",
+		expected:   "testdata/multipleNamespaces.svg.expected",
+	},
+	"denyAllAndToPodEgressOnlySVG": {
+		policies: []string{
+			"testdata/denyAll.input",
+			"testdata/denyToPod.input",
+		},
+		categories: []string{"egress"},
+		namespace:  []string{"default"},
+		format:     "svg",
+		expected:   "testdata/denyAllAndToPod.egress.svg.expected",
+	},
+	"cilium": {
+		policies: []string{
+			"testdata/cilium.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/cilium.expected",
+	},
+	"ciliumDOT": {
+		policies: []string{
+			"testdata/cilium.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		expected:   "testdata/cilium.dot.expected",
+	},
+	"ciliumMermaid": {
+		policies: []string{
+			"testdata/cilium.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "mermaid",
+		expected:   "testdata/cilium.mermaid.expected",
+	},
+	"ciliumJSON": {
+		policies: []string{
+			"testdata/cilium.input",
+		},
+		categories: []string{"egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/cilium.egress.json.expected",
+	},
+	"calico": {
+		policies: []string{
+			"testdata/calico.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/calico.expected",
+	},
+	"calicoDOT": {
+		policies: []string{
+			"testdata/calico.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		expected:   "testdata/calico.dot.expected",
+	},
+	"calicoMermaid": {
+		policies: []string{
+			"testdata/calico.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "mermaid",
+		expected:   "testdata/calico.mermaid.expected",
+	},
+	"calicoSVG": {
+		policies: []string{
+			"testdata/calico.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "svg",
+		expected:   "testdata/calico.svg.expected",
+	},
+	"calicoJSON": {
+		policies: []string{
+			"testdata/calico.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/calico.ingress.json.expected",
+	},
+	"calicoEgressOnly": {
+		// Calico policies with only egress rules do not isolate ingress.
+		policies: []string{
+			"testdata/calicoEgressOnly.input",
+		},
+		categories: []string{"ingress", "egress"},
+		expected:   "testdata/calicoEgressOnly.expected",
+	},
+	"calicoExcept": {
+		policies: []string{
+			"testdata/calicoExcept.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/calicoExcept.expected",
+	},
+	"calicoQuotes": {
+		// Quotes of Calico selectors are escaped in labels.
+		policies: []string{
+			"testdata/calicoQuotes.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/calicoQuotes.expected",
+	},
+	"admin": {
+		policies: []string{
+			"../../pkg/npv/testdata/admin.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/admin.expected",
+	},
+	"adminDOT": {
+		policies: []string{
+			"../../pkg/npv/testdata/admin.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		expected:   "testdata/admin.dot.expected",
+	},
+	"adminMermaid": {
+		policies: []string{
+			"../../pkg/npv/testdata/admin.input",
+		},
+		categories: []string{"ingress", "egress"},
+		namespace:  []string{"default"},
+		format:     "mermaid",
+		expected:   "testdata/admin.mermaid.expected",
+	},
+	"adminJSON": {
+		policies: []string{
+			"../../pkg/npv/testdata/admin.input",
+		},
+		categories: []string{"egress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		expected:   "testdata/admin.egress.json.expected",
+	},
+	"istio": {
+		policies: []string{
+			"../../pkg/npv/testdata/istio.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		istio:      true,
+		expected:   "testdata/istio.ingress.expected",
+	},
+	"istioDOT": {
+		policies: []string{
+			"../../pkg/npv/testdata/istio.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		format:     "dot",
+		istio:      true,
+		expected:   "testdata/istio.ingress.dot.expected",
+	},
+	"istioJSON": {
+		policies: []string{
+			"../../pkg/npv/testdata/istio.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		format:     "json",
+		istio:      true,
+		expected:   "testdata/istio.ingress.json.expected",
+	},
+	"istioDisabled": {
+		policies: []string{
+			"../../pkg/npv/testdata/istio.input",
+		},
+		categories: []string{"ingress"},
+		namespace:  []string{"default"},
+		expected:   "testdata/istio.disabled.expected",
+	},
+	"unsupportedFormat": {
+		policies: []string{
+			"testdata/allowToPod.input",
+		},
+		categories:    []string{"ingress", "egress"},
+		namespace:     []string{"default"},
+		format:        "png",
+		expectedError: "unsupported format: png",
+	},
 }
 
 func TestVisaulizeNamepsaces(t *testing.T) {
@@ -121,7 +495,8 @@ func TestVisaulizeNamepsaces(t *testing.T) {
 		}
 		t.Run(name, func(t *testing.T) {
 			clientset := createFakeClientset(t, tc.policies)
-			actual, err := visualize.VisualizeNamespaces(tc.namespace, clientset, tc.categories, "")
+			dynamicClient := createFakeDynamicClient(t, tc.policies)
+			actual, err := visualize.VisualizeNamespaces(tc.namespace, clientset, dynamicClient, visualize.Options{Categories: tc.categories, Format: tc.format, Istio: tc.istio})
 			if tc.expectedError != "" {
 				require.ErrorContains(t, err, tc.expectedError)
 			} else {
@@ -137,7 +512,7 @@ func TestVisaulizeNamepsaces(t *testing.T) {
 func TestVisaulizeFiles(t *testing.T) {
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			actual, err := visualize.VisualizeFiles(tc.policies, tc.categories, "")
+			actual, err := visualize.VisualizeFiles(readFiles(t, tc.policies), visualize.Options{Categories: tc.categories, Format: tc.format, Istio: tc.istio, KeepGoing: tc.keepGoing})
 			if tc.expectedError != "" {
 				require.ErrorContains(t, err, tc.expectedError)
 			} else {
@@ -150,6 +525,172 @@ func TestVisaulizeFiles(t *testing.T) {
 	}
 }
 
+func TestVisualizeNamespacesResolve(t *testing.T) {
+	clientset := createFakeClientset(t, []string{"testdata/allInOne.input"})
+	addFakeWorkloads(t, clientset, "testdata/resolve.workloads")
+	dynamicClient := createFakeDynamicClient(t, nil)
+	actual, err := visualize.VisualizeNamespaces([]string{"default"}, clientset, dynamicClient, visualize.Options{Categories: []string{"ingress", "egress"}, Format: "plantuml", Resolve: true})
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/allInOne.resolve.expected")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual, actual)
+}
+
+func TestVisualizeFilesResolve(t *testing.T) {
+	actual, err := visualize.VisualizeFiles(readFiles(t, []string{"../../pkg/npv/testdata/manifests.input"}), visualize.Options{Categories: []string{"ingress", "egress"}, Format: "plantuml", Resolve: true})
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/manifests.resolve.expected")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual, actual)
+}
+
+func TestVisualizeChart(t *testing.T) {
+	// Objects rendered without a namespace are put in the release namespace,
+	// so the Deployment of the chart resolves the policy's selector.
+	actual, err := visualize.VisualizeChart("../../pkg/npv/testdata/chart", []string{"../../pkg/npv/testdata/chart.values.yaml"}, visualize.Options{Categories: []string{"ingress", "egress"}, Format: "plantuml", Resolve: true})
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/chart.resolve.expected")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual, actual)
+}
+
+func TestVisualizeKustomization(t *testing.T) {
+	actual, err := visualize.VisualizeKustomization("../../pkg/npv/testdata/kustomize/overlays/prod", visualize.Options{Categories: []string{"ingress", "egress"}, Format: "plantuml"})
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/kustomize.prod.expected")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual, actual)
+}
+
+func addFakeWorkloads(t *testing.T, clientset *fake.Clientset, workloads string) {
+	contents, err := os.ReadFile(workloads)
+	require.NoError(t, err)
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+	for {
+		var raw runtime.RawExtension
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(raw.Raw, nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, clientset.Tracker().Add(obj))
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	copyFile(t, "testdata/allowToPod.input", filepath.Join(dir, "allowToPod.yaml"))
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := visualize.WatchFiles(ctx, []string{dir})
+	require.NoError(t, err)
+	rendered := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- visualize.Watch(ctx, changes, 10*time.Millisecond, func() error {
+			content, err := visualize.VisualizeFiles(readFiles(t, []string{dir}), visualize.Options{Categories: []string{"ingress", "egress"}, Format: "plantuml"})
+			rendered <- content
+			return err
+		})
+	}()
+	waitForRender(t, rendered, "app: pod2")
+	// Directories created while watching are watched too.
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "more"), 0o755))
+	copyFile(t, "testdata/denyToPod.input", filepath.Join(dir, "more", "denyToPod.yaml"))
+	waitForRender(t, rendered, "app: demo")
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestWatchFilesNamed(t *testing.T) {
+	dir := t.TempDir()
+	copyFile(t, "testdata/allowToPod.input", filepath.Join(dir, "allowToPod.yaml"))
+	copyFile(t, "testdata/denyToPod.input", filepath.Join(dir, "denyToPod.yaml"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := visualize.WatchFiles(ctx, []string{filepath.Join(dir, "allowToPod.yaml"), filepath.Join(dir, "later.yaml")})
+	require.NoError(t, err)
+	// Only the named files are watched, not the other files of their
+	// directory.
+	copyFile(t, "testdata/allowToPod.input", filepath.Join(dir, "denyToPod.yaml"))
+	select {
+	case <-changes:
+		t.Fatal("unexpected change")
+	case <-time.After(100 * time.Millisecond):
+	}
+	copyFile(t, "testdata/denyToPod.input", filepath.Join(dir, "allowToPod.yaml"))
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change after writing a named file")
+	}
+	// Files that do not exist yet are seen once created.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-changes:
+	default:
+	}
+	copyFile(t, "testdata/denyToPod.input", filepath.Join(dir, "later.yaml"))
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change after creating a named file")
+	}
+}
+
+func TestWatchNamespaces(t *testing.T) {
+	clientset := createFakeClientset(t, []string{"testdata/allowToPod.input"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := visualize.WatchNamespaces(ctx, clientset, []string{"default"})
+	require.NoError(t, err)
+	// The policies that already exist are not changes.
+	select {
+	case <-changes:
+		t.Fatal("unexpected change")
+	default:
+	}
+	policy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default"}}
+	_, err = clientset.NetworkingV1().NetworkPolicies("default").Create(ctx, policy, metav1.CreateOptions{})
+	require.NoError(t, err)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change after creating a policy")
+	}
+}
+
+// waitForRender waits for a render that contains the given text.
+func waitForRender(t *testing.T, rendered <-chan string, text string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case content := <-rendered:
+			if strings.Contains(content, text) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no render containing %q", text)
+		}
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	contents, err := os.ReadFile(from)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(to, contents, 0o644))
+}
+
+// readFiles reads the manifests in the files, expanding directories.
+func readFiles(t *testing.T, files []string) []npv.Manifest {
+	paths, err := npv.ExpandFiles(files, nil, nil)
+	require.NoError(t, err)
+	manifests, err := npv.ReadFiles(paths, nil)
+	require.NoError(t, err)
+	return manifests
+}
+
 func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
 	objects := []runtime.Object{}
 	for _, policy := range policies {
@@ -163,8 +704,48 @@ func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
 				break
 			}
 			require.NoError(t, err)
+			if obj.Kind != "NetworkPolicy" || obj.GroupVersionKind().Group != networkingv1.GroupName {
+				continue
+			}
 			objects = append(objects, &obj)
 		}
 	}
 	return fake.NewClientset(objects...)
 }
+
+func createFakeDynamicClient(t *testing.T, policies []string) *dynamicfake.FakeDynamicClient {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj map[string]interface{}
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			u := &unstructured.Unstructured{Object: obj}
+			switch {
+			case u.GetKind() == npv.CiliumNetworkPolicyKind || u.GetKind() == npv.CiliumClusterwideNetworkPolicyKind:
+				objects = append(objects, u)
+			case u.GroupVersionKind().Group == npv.CalicoNetworkPolicies.Group:
+				objects = append(objects, u)
+			case u.GroupVersionKind().Group == npv.AdminNetworkPolicies.Group:
+				objects = append(objects, u)
+			case u.GroupVersionKind().Group == npv.AuthorizationPolicies.Group:
+				objects = append(objects, u)
+			}
+		}
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		npv.CiliumNetworkPolicies:            "CiliumNetworkPolicyList",
+		npv.CiliumClusterwideNetworkPolicies: "CiliumClusterwideNetworkPolicyList",
+		npv.CalicoNetworkPolicies:            "NetworkPolicyList",
+		npv.CalicoGlobalNetworkPolicies:      "GlobalNetworkPolicyList",
+		npv.AdminNetworkPolicies:             "AdminNetworkPolicyList",
+		npv.BaselineAdminNetworkPolicies:     "BaselineAdminNetworkPolicyList",
+		npv.AuthorizationPolicies:            "AuthorizationPolicyList",
+	}, objects...)
+}
@@ -0,0 +1,293 @@
+package visualize
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mrxk/npv/pkg/npv"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Watch calls render, and calls it again whenever changes receives once
+// changes have been quiet for the debounce interval, until ctx is done or
+// changes is closed. An error of the first render is returned, while later
+// errors are reported on stderr so that a policy being edited does not stop
+// the watch.
+func Watch(
+	ctx context.Context,
+	changes <-chan struct{},
+	debounce time.Duration,
+	render func() error,
+) error {
+	if err := render(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			if err := render(); err != nil {
+				fmt.Fprintln(os.Stderr, "error: "+err.Error())
+			}
+		}
+	}
+}
+
+// WatchNamespaces returns a channel that receives a value whenever a
+// NetworkPolicy is added, updated or deleted in one of the namespaces, or in
+// any namespace when none are given, until ctx is done. It returns once the
+// informers have listed the existing policies, which are not reported as
+// changes.
+func WatchNamespaces(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	namespaces []string,
+) (<-chan struct{}, error) {
+	changes := make(chan struct{}, 1)
+	handler := cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if !isInInitialList {
+				notify(changes)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) { notify(changes) },
+		DeleteFunc: func(obj interface{}) { notify(changes) },
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+		informer := factory.Networking().V1().NetworkPolicies().Informer()
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, err
+		}
+		factory.Start(ctx.Done())
+		for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return nil, fmt.Errorf("cannot watch %s in namespace %q", informerType, namespace)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// WatchFiles returns a channel that receives a value whenever one of the
+// given files, globs and directories changes, until ctx is done. Files are
+// watched themselves, and so are the files a glob matches along with the
+// directory of the glob, for the files it will match. Directories are watched
+// recursively, including the ones created later, skipping hidden
+// directories, and their hidden files and backups ending with ~, such as
+// those of editors, are ignored. A path that does not exist yet is watched
+// through its directory so that its creation is seen. Changes to other files
+// of the watched directories are ignored.
+func WatchFiles(ctx context.Context, paths []string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watched := &watchedPaths{files: map[string]bool{}}
+	for _, p := range paths {
+		if err := watched.add(watcher, p); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod || !watched.selects(event.Name) {
+					continue
+				}
+				if err := watched.update(watcher, event); err != nil {
+					fmt.Fprintln(os.Stderr, "warning: "+err.Error())
+				}
+				notify(changes)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintln(os.Stderr, "warning: "+err.Error())
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// watchedPaths are the paths given to WatchFiles, by which the events of the
+// watcher are filtered.
+type watchedPaths struct {
+	// files are the files named, or matched by a glob, and the paths that
+	// do not exist yet.
+	files map[string]bool
+	// directories are the directories named, or matched by a glob, which are
+	// watched recursively.
+	directories []string
+	// globs are the globs, whose directory is watched for the files they
+	// will match.
+	globs []string
+}
+
+// add watches a file, glob or directory.
+func (w *watchedPaths) add(watcher *fsnotify.Watcher, p string) error {
+	if p == npv.Stdin {
+		return fmt.Errorf("cannot watch standard input")
+	}
+	p = filepath.Clean(p)
+	matches, err := filepath.Glob(p)
+	if err != nil {
+		return err
+	}
+	if hasMeta(p) {
+		w.globs = append(w.globs, p)
+		if dir := filepath.Dir(p); !hasMeta(dir) {
+			if err := watcher.Add(dir); err != nil {
+				return fmt.Errorf("cannot watch %s: %w", p, err)
+			}
+		} else if len(matches) == 0 {
+			return fmt.Errorf("cannot watch %s: no such file or directory", p)
+		}
+	} else if len(matches) == 0 {
+		if info, err := os.Stat(filepath.Dir(p)); err != nil || !info.IsDir() {
+			return fmt.Errorf("cannot watch %s: no such file or directory", p)
+		}
+		w.files[p] = true
+		return watcher.Add(filepath.Dir(p))
+	}
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			w.directories = append(w.directories, match)
+			if err := watchDirectory(watcher, match); err != nil {
+				return err
+			}
+			continue
+		}
+		w.files[match] = true
+		if err := watcher.Add(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selects reports whether an event of the watcher concerns the watched paths.
+func (w *watchedPaths) selects(name string) bool {
+	name = filepath.Clean(name)
+	if w.files[name] {
+		return true
+	}
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") {
+		return false
+	}
+	if w.matchesGlob(name) {
+		return true
+	}
+	for _, dir := range w.directories {
+		if name == dir || strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// update follows an event. Directories created under a watched directory are
+// watched, and so are the files named or matched by a glob once created. The
+// directory of a named file that is removed or renamed, as editors do when
+// saving, is watched so that the file is seen again.
+func (w *watchedPaths) update(watcher *fsnotify.Watcher, event fsnotify.Event) error {
+	name := filepath.Clean(event.Name)
+	switch {
+	case event.Has(fsnotify.Create):
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil
+		}
+		named := w.files[name] || w.matchesGlob(name)
+		if info.IsDir() {
+			if named && !slices.Contains(w.directories, name) {
+				w.directories = append(w.directories, name)
+			}
+			return watchDirectory(watcher, name)
+		}
+		if named {
+			w.files[name] = true
+			return watcher.Add(name)
+		}
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		if w.files[name] {
+			return watcher.Add(filepath.Dir(name))
+		}
+	}
+	return nil
+}
+
+// matchesGlob reports whether a path is matched by one of the globs.
+func (w *watchedPaths) matchesGlob(name string) bool {
+	for _, glob := range w.globs {
+		if matched, _ := filepath.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMeta reports whether a path holds glob meta characters.
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// watchDirectory watches a directory and its subdirectories, skipping hidden
+// ones.
+func watchDirectory(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// notify sends a value on changes unless one is already pending.
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
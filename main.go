@@ -1,11 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/docopt/docopt-go"
+	"github.com/mrxk/npv/internal/coverage"
+	"github.com/mrxk/npv/internal/diff"
+	"github.com/mrxk/npv/internal/lint"
+	"github.com/mrxk/npv/internal/matrix"
+	"github.com/mrxk/npv/internal/query"
+	"github.com/mrxk/npv/internal/serve"
 	"github.com/mrxk/npv/internal/visualize"
+	"github.com/mrxk/npv/pkg/npv"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -14,26 +30,91 @@ const (
 	usage = `npv - Network Policy Visualizer
 
 Usage:
-	npv visualize [(--namespace=<namespace>...|--file=<file>...)] [--out=<out>] [(--ingress-only|--egress-only)] [--linetype=<type>]
+	npv visualize [(--namespace=<namespace>...|--file=<file>... [--include=<glob>...] [--exclude=<glob>...] [--keep-going] [--git-ref=<ref>]|--chart=<chart> [--values=<values>...] [--keep-going]|--kustomize=<dir> [--keep-going])] [--out=<out>] [(--ingress-only|--egress-only)] [--linetype=<type>] [--format=<format>] [--resolve] [--istio] [--watch]
+	npv matrix [(--namespace=<namespace>...|--file=<file>... [--include=<glob>...] [--exclude=<glob>...] [--keep-going] [--git-ref=<ref>])] [--out=<out>] [(--ingress-only|--egress-only)] [--format=<format>]
+	npv coverage [(--namespace=<namespace>...|--file=<file>... --workloads=<workloads>... [--include=<glob>...] [--exclude=<glob>...] [--keep-going] [--git-ref=<ref>])] [--out=<out>] [(--ingress-only|--egress-only)] [--format=<format>] [--strict]
+	npv query [(--namespace=<namespace>...|--file=<file>... [--include=<glob>...] [--exclude=<glob>...] [--keep-going] [--git-ref=<ref>])] --from=<endpoint> --to=<endpoint> --port=<port>
+	npv diff --old=<old>... --new=<new>... [--keep-going] [--out=<out>] [(--ingress-only|--egress-only)] [--format=<format>]
+	npv diff --git-old=<ref> --git-new=<ref> [--file=<file>...] [--keep-going] [--out=<out>] [(--ingress-only|--egress-only)] [--format=<format>]
+	npv lint [(--namespace=<namespace>...|--file=<file>... [--include=<glob>...] [--exclude=<glob>...] [--keep-going] [--git-ref=<ref>])] [--out=<out>] [--format=<format>] [--strict]
+	npv serve [--namespace=<namespace>...] [--addr=<addr>]
 
 Options:
 	--namespace=<namespace>	Namespace containing Network Policies to visualize
-	--file=<file>	        Path to file containing Network Policies to visualize
+	--file=<file>	        Path to file, glob or directory containing Network Policies to visualize (- for stdin)
+	--include=<glob>        Only read files from --file matching the pattern
+	--exclude=<glob>        Skip files and directories from --file matching the pattern
+	--keep-going            Report documents that cannot be decoded as warnings and go on with the others
+	--git-ref=<ref>         Read --file and --workloads at a revision of the git repository holding the working directory
+	--chart=<chart>         Path to a Helm chart directory or archive to render and visualize
+	--values=<values>       Path to a values file for --chart, later files taking precedence
+	--kustomize=<dir>       Path to a kustomization directory to build and visualize
 	--out=<out>             Path to write visualiztion (- for stdout) (default: -)
 	--ingress-only          Visualize only ingress rules
 	--egress-only           Visualize only egress rules
 	--linetype=<type>       Specify a line type (polyline or ortho)
+	--resolve               Annotate selectors with the pods and namespaces they select in the cluster or files
+	--istio                 Overlay Istio AuthorizationPolicies on the diagram
+	--watch                 Visualize again whenever the inputs or the NetworkPolicies of the cluster change
+	--workloads=<workloads> Path to file containing Pods and Namespaces to check coverage of
+	--strict                Exit with a non-zero status when a namespace or pod is not isolated, or on lint warnings
+	--from=<endpoint>       Source of the connection (namespace/label=value,... or an IP address)
+	--to=<endpoint>         Destination of the connection (namespace/label=value,... or an IP address)
+	--port=<port>           Destination port of the connection (port[/protocol], protocol defaults to TCP)
+	--old=<old>             File or namespace containing the Network Policies to compare from
+	--new=<new>             File or namespace containing the Network Policies to compare to
+	--git-old=<ref>         Revision of the git repository to compare --file at from
+	--git-new=<ref>         Revision of the git repository to compare --file at to (--file defaults to .)
+	--addr=<addr>           Address to serve diagrams on (default: :8080)
+	--format=<format>       Output format
+	                        visualize: plantuml, dot, mermaid, svg, json or html (default: plantuml)
+	                        matrix: text, csv or markdown (default: text)
+	                        coverage: text or json (default: text)
+	                        diff: text, plantuml or dot (default: text)
+	                        lint: text or json (default: text)
 	`
+	// watchDebounce is how long visualize --watch waits for changes to
+	// settle before rendering again.
+	watchDebounce = 500 * time.Millisecond
 )
 
 type arguments struct {
+	Addr        string
+	Chart       string
+	Coverage    bool
+	Diff        bool
 	EgressOnly  bool
+	Exclude     []string
 	File        []string
+	Format      string
+	From        string
+	GitNew      string
+	GitOld      string
+	GitRef      string
+	Include     []string
 	IngressOnly bool
+	Istio       bool
+	KeepGoing   bool
+	Kustomize   string
+	Lint        bool
 	Namespace   []string
+	New         []string
+	Old         []string
 	Out         string
+	Port        string
+	Query       bool
+	Resolve     bool
+	Serve       bool
+	Strict      bool
+	To          string
+	Values      []string
 	Visualize   bool
+	Watch       bool
+	Workloads   []string
 	Linetype    string
+	Matrix      bool
+	// stdin holds standard input when an argument names it.
+	stdin []byte
 }
 
 func main() {
@@ -56,50 +137,383 @@ func bindOpts(opts docopt.Opts) arguments {
 }
 
 func run(args arguments) {
+	handleError(runCommand(args))
+}
+
+func runCommand(args arguments) error {
+	// Standard input is read once so that every argument naming it, and every
+	// render of --watch, reads the same documents.
+	if slices.ContainsFunc([][]string{args.File, args.Workloads, args.Old, args.New}, func(files []string) bool {
+		return slices.Contains(files, npv.Stdin)
+	}) {
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		args.stdin = stdin
+	}
 	switch {
 	case args.Visualize:
-		handleError(runVisualize(args))
+		return runVisualize(args)
+	case args.Matrix:
+		return runMatrix(args)
+	case args.Coverage:
+		return runCoverage(args)
+	case args.Query:
+		return runQuery(args)
+	case args.Diff:
+		return runDiff(args)
+	case args.Lint:
+		return runLint(args)
+	case args.Serve:
+		return runServe(args)
 	}
+	return nil
 }
 
 func runVisualize(args arguments) error {
-	var category []string
+	if args.Watch {
+		return watchVisualize(args)
+	}
+	content, err := visualizeContent(args)
+	if err != nil {
+		return err
+	}
+	return write(args.Out, content)
+}
+
+// watchVisualize visualizes as runVisualize does, and again whenever the
+// chart, kustomization or files change, or the NetworkPolicies of the
+// cluster do, until interrupted. --out is only rewritten when its content
+// changes.
+func watchVisualize(args arguments) error {
+	if args.GitRef != "" {
+		return fmt.Errorf("--watch cannot be used with --git-ref")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var changes <-chan struct{}
+	var err error
 	switch {
-	case args.IngressOnly:
-		category = []string{"ingress"}
-	case args.EgressOnly:
-		category = []string{"egress"}
+	case args.Chart != "":
+		changes, err = visualize.WatchFiles(ctx, append([]string{args.Chart}, args.Values...))
+	case args.Kustomize != "":
+		var paths []string
+		paths, err = npv.KustomizationPaths(args.Kustomize)
+		if err == nil {
+			changes, err = visualize.WatchFiles(ctx, paths)
+		}
+	case len(args.File) > 0:
+		changes, err = visualize.WatchFiles(ctx, args.File)
 	default:
-		category = []string{"ingress", "egress"}
+		var clientset *kubernetes.Clientset
+		clientset, err = getClientset(os.Getenv("KUBECONFIG"))
+		if err == nil {
+			changes, err = visualize.WatchNamespaces(ctx, clientset, args.Namespace)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var previous *string
+	return visualize.Watch(ctx, changes, watchDebounce, func() error {
+		content, err := visualizeContent(args)
+		if err != nil {
+			return err
+		}
+		if previous != nil && *previous == content {
+			return nil
+		}
+		previous = &content
+		return write(args.Out, content)
+	})
+}
+
+// visualizeContent visualizes the chart, kustomization, files or namespaces
+// given by the arguments.
+func visualizeContent(args arguments) (string, error) {
+	options := visualize.Options{
+		Categories: categories(args),
+		Linetype:   args.Linetype,
+		Format:     args.Format,
+		Resolve:    args.Resolve,
+		Istio:      args.Istio,
+		KeepGoing:  args.KeepGoing,
+	}
+	var content string
+	var err error
+	// If given a chart, a kustomization or files, then visualize them.
+	// Otherwise, assume visualization of a cluster is desired.
+	if args.Chart != "" {
+		content, err = visualize.VisualizeChart(args.Chart, args.Values, options)
+	} else if args.Kustomize != "" {
+		content, err = visualize.VisualizeKustomization(args.Kustomize, options)
+	} else if len(args.File) > 0 {
+		var files []npv.Manifest
+		files, err = inputFiles(args)
+		if err == nil {
+			content, err = visualize.VisualizeFiles(files, options)
+		}
+	} else {
+		var clientset *kubernetes.Clientset
+		var dynamicClient *dynamic.DynamicClient
+		clientset, err = getClientset(os.Getenv("KUBECONFIG"))
+		if err == nil {
+			dynamicClient, err = getDynamicClient(os.Getenv("KUBECONFIG"))
+		}
+		if err == nil {
+			content, err = visualize.VisualizeNamespaces(args.Namespace, clientset, dynamicClient, options)
+		}
 	}
+	return content, err
+}
+
+func runMatrix(args arguments) error {
+	category := categories(args)
 	var content string
 	var err error
-	// If given files, then visualize files. Otherwise, assume visualization of
-	// a cluster is desired.
+	// If given files, then use files. Otherwise, assume the cluster is
+	// desired.
 	if len(args.File) > 0 {
-		content, err = visualize.VisualizeFiles(args.File, category, args.Linetype)
+		var files []npv.Manifest
+		files, err = inputFiles(args)
+		if err == nil {
+			content, err = matrix.MatrixFiles(files, category, args.Format, args.KeepGoing)
+		}
 	} else {
 		var clientset *kubernetes.Clientset
 		clientset, err = getClientset(os.Getenv("KUBECONFIG"))
 		if err == nil {
-			content, err = visualize.VisualizeNamespaces(args.Namespace, clientset, category, args.Linetype)
+			content, err = matrix.MatrixNamespaces(args.Namespace, clientset, category, args.Format)
 		}
 	}
 	if err != nil {
 		return err
 	}
-	if len(args.Out) == 0 || args.Out == "-" {
-		fmt.Println(content)
+	return write(args.Out, content)
+}
+
+func runCoverage(args arguments) error {
+	category := categories(args)
+	var content string
+	var covered bool
+	var err error
+	// If given files, then use files. Otherwise, assume the cluster is
+	// desired.
+	if len(args.File) > 0 {
+		var files []npv.Manifest
+		var workloads []npv.Manifest
+		files, err = inputFiles(args)
+		if err == nil {
+			workloads, err = workloadFiles(args)
+		}
+		if err == nil {
+			content, covered, err = coverage.CoverageFiles(files, workloads, category, args.Format, args.KeepGoing)
+		}
 	} else {
-		w, err := os.Create(args.Out)
-		if err != nil {
-			return err
+		var clientset *kubernetes.Clientset
+		clientset, err = getClientset(os.Getenv("KUBECONFIG"))
+		if err == nil {
+			content, covered, err = coverage.CoverageNamespaces(args.Namespace, clientset, category, args.Format)
 		}
-		fmt.Fprintln(w, content)
+	}
+	if err != nil {
+		return err
+	}
+	if err := write(args.Out, content); err != nil {
+		return err
+	}
+	if args.Strict && !covered {
+		return fmt.Errorf("not all namespaces and pods are isolated")
 	}
 	return nil
 }
 
+func runQuery(args arguments) error {
+	var content string
+	var err error
+	// If given files, then use files. Otherwise, assume the cluster is
+	// desired.
+	if len(args.File) > 0 {
+		var files []npv.Manifest
+		files, err = inputFiles(args)
+		if err == nil {
+			content, err = query.QueryFiles(files, args.From, args.To, args.Port, args.KeepGoing)
+		}
+	} else {
+		var clientset *kubernetes.Clientset
+		var dynamicClient *dynamic.DynamicClient
+		clientset, err = getClientset(os.Getenv("KUBECONFIG"))
+		if err == nil {
+			dynamicClient, err = getDynamicClient(os.Getenv("KUBECONFIG"))
+		}
+		if err == nil {
+			content, err = query.QueryNamespaces(args.Namespace, clientset, dynamicClient, args.From, args.To, args.Port)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Print(content)
+	return nil
+}
+
+func runDiff(args arguments) error {
+	category := categories(args)
+	// Sources that are not files are namespaces, so only connect to the
+	// cluster when one is read.
+	clientset := func() (kubernetes.Interface, error) {
+		return getClientset(os.Getenv("KUBECONFIG"))
+	}
+	var oldSource, newSource diff.Source
+	var err error
+	// Compare the files at two git revisions rather than the given sources.
+	if args.GitOld != "" {
+		oldSource, err = revisionSource(args.GitOld, args)
+		if err == nil {
+			newSource, err = revisionSource(args.GitNew, args)
+		}
+	} else {
+		oldSource, err = diff.ReadSources(args.Old, bytes.NewReader(args.stdin))
+		if err == nil {
+			newSource, err = diff.ReadSources(args.New, bytes.NewReader(args.stdin))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	content, err := diff.Diff(oldSource, newSource, clientset, category, args.Format, args.KeepGoing)
+	if err != nil {
+		return err
+	}
+	return write(args.Out, content)
+}
+
+func runLint(args arguments) error {
+	var content string
+	var severity npv.Severity
+	var err error
+	// If given files, then use files. Otherwise, assume the cluster is
+	// desired.
+	if len(args.File) > 0 {
+		var files []npv.Manifest
+		files, err = inputFiles(args)
+		if err == nil {
+			content, severity, err = lint.LintFiles(files, args.Format, args.KeepGoing)
+		}
+	} else {
+		var clientset *kubernetes.Clientset
+		clientset, err = getClientset(os.Getenv("KUBECONFIG"))
+		if err == nil {
+			content, severity, err = lint.LintNamespaces(args.Namespace, clientset, args.Format)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := write(args.Out, content); err != nil {
+		return err
+	}
+	if severity == npv.Error || (args.Strict && severity == npv.Warning) {
+		return fmt.Errorf("lint found problems")
+	}
+	return nil
+}
+
+// runServe serves the diagrams of the NetworkPolicies in the cluster over
+// HTTP until interrupted.
+func runServe(args arguments) error {
+	clientset, err := getClientset(os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	handler, err := serve.NewServer(ctx, clientset, args.Namespace)
+	if err != nil {
+		return err
+	}
+	addr := args.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	fmt.Fprintln(os.Stderr, "serving diagrams on "+addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// revisionSource reads the files that --file names at a git revision, for
+// diff, which defaults to the working directory.
+func revisionSource(revision string, args arguments) (diff.Source, error) {
+	paths := args.File
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := npv.ReadRevision(revision, paths, nil, nil, bytes.NewReader(args.stdin))
+	if err != nil {
+		return diff.Source{}, err
+	}
+	return diff.Source{Manifests: files}, nil
+}
+
+// inputFiles reads the files named by --file, filtered by --include and
+// --exclude, at the revision of --git-ref when given.
+func inputFiles(args arguments) ([]npv.Manifest, error) {
+	if args.GitRef != "" {
+		return npv.ReadRevision(args.GitRef, args.File, args.Include, args.Exclude, bytes.NewReader(args.stdin))
+	}
+	paths, err := npv.ExpandFiles(args.File, args.Include, args.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return npv.ReadFiles(paths, bytes.NewReader(args.stdin))
+}
+
+// workloadFiles reads the files named by --workloads, at the revision of
+// --git-ref when given.
+func workloadFiles(args arguments) ([]npv.Manifest, error) {
+	if args.GitRef != "" {
+		return npv.ReadRevision(args.GitRef, args.Workloads, nil, nil, bytes.NewReader(args.stdin))
+	}
+	paths, err := npv.ExpandFiles(args.Workloads, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return npv.ReadFiles(paths, bytes.NewReader(args.stdin))
+}
+
+func categories(args arguments) []string {
+	switch {
+	case args.IngressOnly:
+		return []string{"ingress"}
+	case args.EgressOnly:
+		return []string{"egress"}
+	default:
+		return []string{"ingress", "egress"}
+	}
+}
+
+func write(out string, content string) error {
+	if len(out) == 0 || out == "-" {
+		fmt.Println(content)
+		return nil
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	fmt.Fprintln(w, content)
+	return nil
+}
+
 func handleError(err error) {
 	if err != nil {
 		fmt.Println(err.Error())
@@ -114,3 +528,11 @@ func getClientset(kubeconfig string) (*kubernetes.Clientset, error) {
 	}
 	return kubernetes.NewForConfig(config)
 }
+
+func getDynamicClient(kubeconfig string) (*dynamic.DynamicClient, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
@@ -0,0 +1,360 @@
+package npv
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// AdminNetworkPolicyKind is the kind of admin network policies, which
+	// are evaluated before network policies.
+	AdminNetworkPolicyKind = "AdminNetworkPolicy"
+	// BaselineAdminNetworkPolicyKind is the kind of the baseline admin
+	// network policy, which is evaluated after network policies.
+	BaselineAdminNetworkPolicyKind = "BaselineAdminNetworkPolicy"
+)
+
+var (
+	// AdminNetworkPolicies is the resource of AdminNetworkPolicy.
+	AdminNetworkPolicies = schema.GroupVersionResource{Group: "policy.networking.k8s.io", Version: "v1alpha1", Resource: "adminnetworkpolicies"}
+	// BaselineAdminNetworkPolicies is the resource of
+	// BaselineAdminNetworkPolicy.
+	BaselineAdminNetworkPolicies = schema.GroupVersionResource{Group: "policy.networking.k8s.io", Version: "v1alpha1", Resource: "baselineadminnetworkpolicies"}
+)
+
+// AdminNetworkPolicy is a policy.networking.k8s.io/v1alpha1
+// AdminNetworkPolicy or BaselineAdminNetworkPolicy. Only the fields npv draws
+// are decoded.
+type AdminNetworkPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              AdminNetworkPolicySpec `json:"spec"`
+}
+
+// Baseline reports whether the policy is a BaselineAdminNetworkPolicy.
+func (p AdminNetworkPolicy) Baseline() bool {
+	return p.Kind == BaselineAdminNetworkPolicyKind
+}
+
+// AdminNetworkPolicySpec selects pods and lists the rules applied to their
+// traffic. Admin network policies are applied in increasing priority, and
+// the first rule that matches decides. Baseline admin network policies have no
+// priority.
+type AdminNetworkPolicySpec struct {
+	Priority int32                     `json:"priority,omitempty"`
+	Subject  AdminNetworkPolicySubject `json:"subject"`
+	Ingress  []AdminNetworkPolicyRule  `json:"ingress,omitempty"`
+	Egress   []AdminNetworkPolicyRule  `json:"egress,omitempty"`
+}
+
+// AdminNetworkPolicySubject selects all pods in some namespaces or some pods
+// in some namespaces.
+type AdminNetworkPolicySubject struct {
+	Namespaces *metav1.LabelSelector `json:"namespaces,omitempty"`
+	Pods       *NamespacedPod        `json:"pods,omitempty"`
+}
+
+// NamespacedPod selects pods in namespaces.
+type NamespacedPod struct {
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector"`
+	PodSelector       metav1.LabelSelector `json:"podSelector"`
+}
+
+// AdminNetworkPolicyRule applies an action to traffic with peers on ports.
+// From is set for ingress rules and To for egress rules. No ports means all
+// ports.
+type AdminNetworkPolicyRule struct {
+	Name   string                   `json:"name,omitempty"`
+	Action Action                   `json:"action"`
+	From   []AdminNetworkPolicyPeer `json:"from,omitempty"`
+	To     []AdminNetworkPolicyPeer `json:"to,omitempty"`
+	Ports  []AdminNetworkPolicyPort `json:"ports,omitempty"`
+}
+
+// AdminNetworkPolicyPeer is one of namespaces, pods, nodes, networks or
+// domain names.
+type AdminNetworkPolicyPeer struct {
+	Namespaces  *metav1.LabelSelector `json:"namespaces,omitempty"`
+	Pods        *NamespacedPod        `json:"pods,omitempty"`
+	Nodes       *metav1.LabelSelector `json:"nodes,omitempty"`
+	Networks    []string              `json:"networks,omitempty"`
+	DomainNames []string              `json:"domainNames,omitempty"`
+}
+
+// AdminNetworkPolicyPort is one of a port number, a named port or a port
+// range.
+type AdminNetworkPolicyPort struct {
+	PortNumber *AdminNetworkPolicyPortNumber `json:"portNumber,omitempty"`
+	NamedPort  *string                       `json:"namedPort,omitempty"`
+	PortRange  *AdminNetworkPolicyPortRange  `json:"portRange,omitempty"`
+}
+
+// AdminNetworkPolicyPortNumber is a port and protocol. An empty protocol is
+// TCP.
+type AdminNetworkPolicyPortNumber struct {
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+	Port     int32           `json:"port"`
+}
+
+// AdminNetworkPolicyPortRange is a range of ports and protocol. An empty
+// protocol is TCP.
+type AdminNetworkPolicyPortRange struct {
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+	Start    int32           `json:"start"`
+	End      int32           `json:"end"`
+}
+
+// LoadAdminPolicies returns the AdminNetworkPolicies and
+// BaselineAdminNetworkPolicies of a cluster. Both are cluster wide. No
+// policies are returned when the API is not installed.
+func LoadAdminPolicies(ctx context.Context, client dynamic.Interface) ([]AdminNetworkPolicy, error) {
+	items := []AdminNetworkPolicy{}
+	for _, resource := range []schema.GroupVersionResource{AdminNetworkPolicies, BaselineAdminNetworkPolicies} {
+		list, err := client.Resource(resource).List(ctx, metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			var policy AdminNetworkPolicy
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &policy); err != nil {
+				return nil, err
+			}
+			items = append(items, policy)
+		}
+	}
+	return items, nil
+}
+
+// LoadAdminFiles returns the AdminNetworkPolicies and
+// BaselineAdminNetworkPolicies in the given files. Each file may be a glob and
+// may contain multiple YAML or JSON documents. Other kinds are ignored and
+// documents that cannot be decoded are returned as DecodeErrors, as with
+// LoadFiles.
+func LoadAdminFiles(files []string) ([]AdminNetworkPolicy, error) {
+	return loadFiles(files, (*Objects).AdminPolicies)
+}
+
+// AdminPolicies returns the AdminNetworkPolicies and
+// BaselineAdminNetworkPolicies among the objects. Objects that cannot be
+// converted are returned as DecodeErrors along with the others.
+func (o *Objects) AdminPolicies() ([]AdminNetworkPolicy, error) {
+	items := []AdminNetworkPolicy{}
+	err := o.each(func(obj *unstructured.Unstructured) error {
+		gvk := obj.GroupVersionKind()
+		if gvk.Group != AdminNetworkPolicies.Group {
+			return nil
+		}
+		if gvk.Kind != AdminNetworkPolicyKind && gvk.Kind != BaselineAdminNetworkPolicyKind {
+			return nil
+		}
+		var policy AdminNetworkPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+			return err
+		}
+		items = append(items, policy)
+		return nil
+	})
+	return items, err
+}
+
+// AddAdminPolicies adds the pods selected by admin and baseline admin network
+// policies, and the peers they exchange traffic with, to the model. Their pod
+// groups are drawn in tiers of their own before and after those of network
+// policies. Every rule keeps its action and its precedence, the priority of
+// its policy and its index in the policy.
+func (m *Model) AddAdminPolicies(policies []AdminNetworkPolicy) {
+	for _, policy := range policies {
+		namespaces, selector := policy.Spec.Subject.selectors()
+		prefix := "_ADMIN_"
+		if policy.Baseline() {
+			prefix = "_BASELINE_"
+		}
+		key := prefix + podKey("", selector) + "_NS_" + labelSelectorID(namespaces)
+		p, present := m.pods[key]
+		if !present {
+			p = pod{
+				id:                key,
+				selector:          selector,
+				clusterWide:       true,
+				namespaceSelector: &namespaces,
+				tier:              policy.Kind,
+			}
+		}
+		name := policy.Kind + "/" + policy.Name
+		if !slices.Contains(p.names, name) {
+			p.names = append(p.names, name)
+		}
+		for i, rule := range policy.Spec.Ingress {
+			p.ingress = append(p.ingress, adminTargets(rule, rule.From, adminPrecedence(policy, i))...)
+		}
+		for i, rule := range policy.Spec.Egress {
+			p.egress = append(p.egress, adminTargets(rule, rule.To, adminPrecedence(policy, i))...)
+		}
+		m.pods[key] = p
+	}
+	m.pods = sorted(m.pods)
+}
+
+// selectors returns the namespace and pod selectors of a subject.
+func (s AdminNetworkPolicySubject) selectors() (metav1.LabelSelector, metav1.LabelSelector) {
+	if s.Pods != nil {
+		return s.Pods.NamespaceSelector, s.Pods.PodSelector
+	}
+	if s.Namespaces != nil {
+		return *s.Namespaces, metav1.LabelSelector{}
+	}
+	return metav1.LabelSelector{}, metav1.LabelSelector{}
+}
+
+// adminPrecedence describes when a rule of a policy is evaluated.
+func adminPrecedence(policy AdminNetworkPolicy, index int) string {
+	if policy.Baseline() {
+		return fmt.Sprintf("baseline rule %d", index)
+	}
+	return fmt.Sprintf("priority %d rule %d", policy.Spec.Priority, index)
+}
+
+// adminTargets returns a target for every combination of peer and port of a
+// rule.
+func adminTargets(rule AdminNetworkPolicyRule, peers []AdminNetworkPolicyPeer, precedence string) []target {
+	templates := []target{}
+	for _, peer := range peers {
+		for _, p := range peer.networkPolicyPeers() {
+			templates = append(templates, target{peerId: peerID(p), peer: p})
+		}
+		if peer.Nodes != nil {
+			nodes := *peer.Nodes
+			templates = append(templates, target{peerId: "_NODES_" + labelSelectorID(nodes), nodes: &nodes})
+		}
+		for _, name := range peer.DomainNames {
+			templates = append(templates, target{peerId: fqdnPeerID(name), fqdn: name})
+		}
+	}
+	targets := []target{}
+	for _, template := range templates {
+		for _, port := range adminPorts(rule.Ports) {
+			t := template
+			t.port = port
+			t.action = rule.Action
+			t.precedence = precedence
+			t.id = orderedTargetKey(t.peerId, port, precedence, rule.Action)
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// networkPolicyPeers converts the namespaces, pods and networks of a peer into
+// network policy peers.
+func (p AdminNetworkPolicyPeer) networkPolicyPeers() []networkingv1.NetworkPolicyPeer {
+	peers := []networkingv1.NetworkPolicyPeer{}
+	if p.Namespaces != nil {
+		namespaces := *p.Namespaces
+		peers = append(peers, networkingv1.NetworkPolicyPeer{NamespaceSelector: &namespaces})
+	}
+	if p.Pods != nil {
+		namespaces, pods := p.Pods.NamespaceSelector, p.Pods.PodSelector
+		peers = append(peers, networkingv1.NetworkPolicyPeer{NamespaceSelector: &namespaces, PodSelector: &pods})
+	}
+	for _, network := range p.Networks {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: network}})
+	}
+	return peers
+}
+
+// adminPorts converts ports into network policy ports. Protocols default to
+// TCP. No ports means all ports.
+func adminPorts(ports []AdminNetworkPolicyPort) []networkingv1.NetworkPolicyPort {
+	result := []networkingv1.NetworkPolicyPort{}
+	for _, p := range ports {
+		switch {
+		case p.PortNumber != nil:
+			protocol := cmp.Or(p.PortNumber.Protocol, corev1.ProtocolTCP)
+			port := intstr.FromInt32(p.PortNumber.Port)
+			result = append(result, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port})
+		case p.NamedPort != nil:
+			port := intstr.FromString(*p.NamedPort)
+			result = append(result, networkingv1.NetworkPolicyPort{Port: &port})
+		case p.PortRange != nil:
+			protocol := cmp.Or(p.PortRange.Protocol, corev1.ProtocolTCP)
+			port := intstr.FromInt32(p.PortRange.Start)
+			end := p.PortRange.End
+			result = append(result, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port, EndPort: &end})
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, networkingv1.NetworkPolicyPort{})
+	}
+	return result
+}
+
+// selects reports whether the subject of a policy selects the endpoint.
+func (p AdminNetworkPolicy) selects(e Endpoint) bool {
+	if !e.IsPod() {
+		return false
+	}
+	namespaces, pods := p.Spec.Subject.selectors()
+	return selectorMatches(namespaces, e.namespaceLabels()) && selectorMatches(pods, e.Labels)
+}
+
+// matches reports whether a rule matches traffic with the endpoint on the
+// port. Nodes and domain names are never matched because the nodes and names
+// of endpoints are unknown.
+func (r AdminNetworkPolicyRule) matches(peers []AdminNetworkPolicyPeer, e Endpoint, port Port) bool {
+	if !portsMatch(adminRulePorts(r.Ports), port) {
+		return false
+	}
+	for _, peer := range peers {
+		for _, p := range peer.networkPolicyPeers() {
+			if peerMatches(p, "", e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adminRulePorts converts the ports of a rule for portsMatch, which matches
+// every port when there are none.
+func adminRulePorts(ports []AdminNetworkPolicyPort) []networkingv1.NetworkPolicyPort {
+	if len(ports) == 0 {
+		return nil
+	}
+	return adminPorts(ports)
+}
+
+// sortedAdminPolicies returns the admin network policies in order of
+// evaluation and the baseline admin network policies.
+func sortedAdminPolicies(policies []AdminNetworkPolicy) ([]AdminNetworkPolicy, []AdminNetworkPolicy) {
+	admin, baseline := []AdminNetworkPolicy{}, []AdminNetworkPolicy{}
+	for _, policy := range policies {
+		if policy.Baseline() {
+			baseline = append(baseline, policy)
+		} else {
+			admin = append(admin, policy)
+		}
+	}
+	slices.SortStableFunc(admin, func(l, r AdminNetworkPolicy) int {
+		if c := cmp.Compare(l.Spec.Priority, r.Spec.Priority); c != 0 {
+			return c
+		}
+		return strings.Compare(l.Name, r.Name)
+	})
+	return admin, baseline
+}
@@ -0,0 +1,435 @@
+package npv
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// CalicoNetworkPolicyKind is the kind of namespaced Calico policies.
+	CalicoNetworkPolicyKind = "NetworkPolicy"
+	// CalicoGlobalNetworkPolicyKind is the kind of cluster wide Calico
+	// policies.
+	CalicoGlobalNetworkPolicyKind = "GlobalNetworkPolicy"
+
+	// calicoSelectorOperator is the operator of the match expression that
+	// holds Calico selectors that cannot be converted into label selectors.
+	calicoSelectorOperator metav1.LabelSelectorOperator = "Matches"
+)
+
+var (
+	// CalicoNetworkPolicies is the resource of Calico NetworkPolicy.
+	CalicoNetworkPolicies = schema.GroupVersionResource{Group: "projectcalico.org", Version: "v3", Resource: "networkpolicies"}
+	// CalicoGlobalNetworkPolicies is the resource of Calico
+	// GlobalNetworkPolicy.
+	CalicoGlobalNetworkPolicies = schema.GroupVersionResource{Group: "projectcalico.org", Version: "v3", Resource: "globalnetworkpolicies"}
+
+	// calicoCRDGroupVersion is the group version Calico stores policies in.
+	// It is read when the Calico API server is not installed.
+	calicoCRDGroupVersion = schema.GroupVersion{Group: "crd.projectcalico.org", Version: "v1"}
+
+	calicoEqualTerm    = regexp.MustCompile(`^([\w./-]+)\s*(==|!=)\s*['"]([^'"]*)['"]$`)
+	calicoHasTerm      = regexp.MustCompile(`^(!?)\s*has\(\s*([\w./-]+)\s*\)$`)
+	calicoInTerm       = regexp.MustCompile(`^([\w./-]+)\s+(not\s+)?in\s*\{([^}]*)\}$`)
+	calicoSelectorTerm = regexp.MustCompile(`\s*&&\s*`)
+)
+
+// CalicoNetworkPolicy is a projectcalico.org/v3 NetworkPolicy or
+// GlobalNetworkPolicy. Only the fields npv draws are decoded.
+type CalicoNetworkPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              CalicoPolicySpec `json:"spec"`
+}
+
+// Global reports whether the policy is a GlobalNetworkPolicy.
+func (p CalicoNetworkPolicy) Global() bool {
+	return p.Kind == CalicoGlobalNetworkPolicyKind
+}
+
+// CalicoPolicySpec selects endpoints and lists the rules applied to their
+// traffic. Policies are applied in increasing order, and policies without an
+// order last. The first rule that allows, denies or passes the traffic decides.
+type CalicoPolicySpec struct {
+	Tier              string       `json:"tier,omitempty"`
+	Order             *float64     `json:"order,omitempty"`
+	Selector          string       `json:"selector,omitempty"`
+	NamespaceSelector string       `json:"namespaceSelector,omitempty"`
+	Types             []string     `json:"types,omitempty"`
+	Ingress           []CalicoRule `json:"ingress,omitempty"`
+	Egress            []CalicoRule `json:"egress,omitempty"`
+}
+
+// CalicoRule applies an action to the traffic between the source and the
+// destination.
+type CalicoRule struct {
+	Action      Action              `json:"action"`
+	Protocol    *intstr.IntOrString `json:"protocol,omitempty"`
+	Source      CalicoEntityRule    `json:"source,omitempty"`
+	Destination CalicoEntityRule    `json:"destination,omitempty"`
+}
+
+// CalicoEntityRule matches the source or destination of traffic. Ports are
+// numbers, ranges such as 8000:8080 or names. The not fields exclude the
+// traffic their positive counterparts would match.
+type CalicoEntityRule struct {
+	Nets              []string             `json:"nets,omitempty"`
+	NotNets           []string             `json:"notNets,omitempty"`
+	Selector          string               `json:"selector,omitempty"`
+	NotSelector       string               `json:"notSelector,omitempty"`
+	NamespaceSelector string               `json:"namespaceSelector,omitempty"`
+	Ports             []intstr.IntOrString `json:"ports,omitempty"`
+	NotPorts          []intstr.IntOrString `json:"notPorts,omitempty"`
+}
+
+// LoadCalicoNamespaces returns the Calico NetworkPolicies in the given
+// namespaces, or in all namespaces when none are given, and all
+// GlobalNetworkPolicies. Policies are read from the custom resources Calico
+// stores them in when the Calico API server is not installed. No policies are
+// returned when Calico is not installed.
+func LoadCalicoNamespaces(ctx context.Context, client dynamic.Interface, namespaces []string) ([]CalicoNetworkPolicy, error) {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	crdPolicies := calicoCRDGroupVersion.WithResource(CalicoNetworkPolicies.Resource)
+	crdGlobalPolicies := calicoCRDGroupVersion.WithResource(CalicoGlobalNetworkPolicies.Resource)
+	items, err := loadCalico(ctx, client, CalicoNetworkPolicies, CalicoGlobalNetworkPolicies, namespaces)
+	if apierrors.IsNotFound(err) {
+		items, err = loadCalico(ctx, client, crdPolicies, crdGlobalPolicies, namespaces)
+	}
+	if apierrors.IsNotFound(err) {
+		return []CalicoNetworkPolicy{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func loadCalico(ctx context.Context, client dynamic.Interface, policies, globalPolicies schema.GroupVersionResource, namespaces []string) ([]CalicoNetworkPolicy, error) {
+	lists := []*unstructured.UnstructuredList{}
+	for _, namespace := range namespaces {
+		list, err := client.Resource(policies).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	list, err := client.Resource(globalPolicies).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	lists = append(lists, list)
+	items := []CalicoNetworkPolicy{}
+	for _, list := range lists {
+		for _, item := range list.Items {
+			var policy CalicoNetworkPolicy
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &policy); err != nil {
+				return nil, err
+			}
+			items = append(items, policy)
+		}
+	}
+	return items, nil
+}
+
+// LoadCalicoFiles returns the Calico NetworkPolicies and GlobalNetworkPolicies
+// in the given files. Each file may be a glob and may contain multiple YAML or
+// JSON documents. Other kinds, and network policies of other APIs, are
+// ignored. Documents that cannot be decoded are returned as DecodeErrors, as
+// with LoadFiles.
+func LoadCalicoFiles(files []string) ([]CalicoNetworkPolicy, error) {
+	return loadFiles(files, (*Objects).CalicoPolicies)
+}
+
+// CalicoPolicies returns the Calico NetworkPolicies and GlobalNetworkPolicies
+// among the objects. Objects that cannot be converted are returned as
+// DecodeErrors along with the others.
+func (o *Objects) CalicoPolicies() ([]CalicoNetworkPolicy, error) {
+	items := []CalicoNetworkPolicy{}
+	err := o.each(func(obj *unstructured.Unstructured) error {
+		gvk := obj.GroupVersionKind()
+		if gvk.Group != CalicoNetworkPolicies.Group && gvk.Group != calicoCRDGroupVersion.Group {
+			return nil
+		}
+		if gvk.Kind != CalicoNetworkPolicyKind && gvk.Kind != CalicoGlobalNetworkPolicyKind {
+			return nil
+		}
+		var policy CalicoNetworkPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+			return err
+		}
+		items = append(items, policy)
+		return nil
+	})
+	return items, err
+}
+
+// AddCalicoPolicies adds the pods selected by Calico policies, and the peers
+// they exchange traffic with, to the model. Every rule keeps its action and its
+// precedence, the order of its policy and its index in the policy. Selector
+// expressions become label selectors and nets become IP blocks.
+func (m *Model) AddCalicoPolicies(policies []CalicoNetworkPolicy) {
+	for _, policy := range policies {
+		selector := calicoSelector(policy.Spec.Selector)
+		key := podKey(policy.Namespace, selector)
+		var namespaceSelector *metav1.LabelSelector
+		if policy.Global() {
+			key = "_CLUSTER_" + podKey("", selector)
+			if policy.Spec.NamespaceSelector != "" {
+				s := calicoSelector(policy.Spec.NamespaceSelector)
+				namespaceSelector = &s
+				key += "_NS_" + labelSelectorID(s)
+			}
+		}
+		p, present := m.pods[key]
+		if !present {
+			p = pod{
+				id:                key,
+				namespace:         policy.Namespace,
+				selector:          selector,
+				clusterWide:       policy.Global(),
+				namespaceSelector: namespaceSelector,
+			}
+		}
+		name := strings.ToLower(policy.Kind) + "." + CalicoNetworkPolicies.Group + "/" + policy.Name
+		if !slices.Contains(p.names, name) {
+			p.names = append(p.names, name)
+		}
+		// Policies without types get the defaults of Calico: Ingress when
+		// the policy has ingress rules or no rules at all, and Egress when it
+		// has egress rules. Unlike network policies, a policy with only
+		// egress rules does not isolate ingress.
+		types := policy.Spec.Types
+		if len(types) == 0 {
+			if len(policy.Spec.Ingress) > 0 || len(policy.Spec.Egress) == 0 {
+				types = append(types, string(networkingv1.PolicyTypeIngress))
+			}
+			if len(policy.Spec.Egress) > 0 {
+				types = append(types, string(networkingv1.PolicyTypeEgress))
+			}
+		}
+		if slices.Contains(types, string(networkingv1.PolicyTypeIngress)) {
+			p.ingress = append(p.ingress, calicoTargets(policy, policy.Spec.Ingress, "_ALL_PEER_INGRESS", func(rule CalicoRule) CalicoEntityRule {
+				return rule.Source
+			})...)
+			if len(policy.Spec.Ingress) == 0 {
+				p.ingress = append(p.ingress, target{id: p.id + "_ALL_", peerId: "_ALL_PEER_INGRESS_", blockAll: true})
+			}
+		}
+		if slices.Contains(types, string(networkingv1.PolicyTypeEgress)) {
+			p.egress = append(p.egress, calicoTargets(policy, policy.Spec.Egress, "_ALL_PEER_EGRESS_", func(rule CalicoRule) CalicoEntityRule {
+				return rule.Destination
+			})...)
+			if len(policy.Spec.Egress) == 0 {
+				p.egress = append(p.egress, target{id: p.id + "_ALL_", peerId: "_ALL_PEER_EGRESS_", blockAll: true})
+			}
+		}
+		m.pods[key] = p
+	}
+	m.pods = sorted(m.pods)
+}
+
+// calicoTargets returns a target for every combination of peer and port of the
+// given rules. The peer of a rule is the entity returned by peerOf. A rule
+// without a peer applies to every peer. The nets and selector a rule excludes
+// from its peer, and the ports it excludes, are kept as its exceptions.
+func calicoTargets(policy CalicoNetworkPolicy, rules []CalicoRule, allPeerId string, peerOf func(CalicoRule) CalicoEntityRule) []target {
+	targets := []target{}
+	for i, rule := range rules {
+		templates := []target{}
+		for _, peer := range calicoPeers(peerOf(rule), policy.Global()) {
+			templates = append(templates, target{peerId: peerID(peer), peer: peer})
+		}
+		if len(templates) == 0 {
+			templates = append(templates, target{peerId: allPeerId, allPeers: true, allowAll: rule.Action == Allow})
+		}
+		except := calicoExceptions(peerOf(rule), rule.Destination)
+		precedence := calicoPrecedence(policy.Spec, i)
+		for _, template := range templates {
+			if len(except) > 0 {
+				template.except = except
+				template.peerId += "_EXCEPT_" + normalizePlantUMLId(strings.ReplaceAll(strings.Join(except, "_"), " ", "_"))
+			}
+			for _, port := range calicoPorts(rule.Protocol, rule.Destination.Ports) {
+				t := template
+				t.port = port
+				t.action = rule.Action
+				t.precedence = precedence
+				t.id = orderedTargetKey(t.peerId, port, precedence, rule.Action)
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// calicoExceptions describes the nets and selector excluded from a peer and
+// the destination ports excluded from a rule.
+func calicoExceptions(peer CalicoEntityRule, destination CalicoEntityRule) []string {
+	except := []string{}
+	if len(peer.NotNets) > 0 {
+		except = append(except, "nets "+strings.Join(peer.NotNets, ", "))
+	}
+	if peer.NotSelector != "" {
+		except = append(except, "selector "+peer.NotSelector)
+	}
+	if len(destination.NotPorts) > 0 {
+		ports := []string{}
+		for _, port := range destination.NotPorts {
+			ports = append(ports, port.String())
+		}
+		except = append(except, "ports "+strings.Join(ports, ", "))
+	}
+	return except
+}
+
+// calicoPrecedence describes when a rule of a policy is evaluated.
+func calicoPrecedence(spec CalicoPolicySpec, index int) string {
+	precedence := fmt.Sprintf("rule %d", index)
+	if spec.Order != nil {
+		precedence = fmt.Sprintf("order %s %s", strconv.FormatFloat(*spec.Order, 'f', -1, 64), precedence)
+	}
+	if spec.Tier != "" && spec.Tier != "default" {
+		precedence = fmt.Sprintf("tier %s %s", spec.Tier, precedence)
+	}
+	return precedence
+}
+
+// calicoPeers converts the selectors and nets of an entity into peers.
+// Selectors of namespaced policies without a namespace selector only select
+// endpoints in the policy's namespace, like pod selectors of network policies,
+// while those of global policies select endpoints in every namespace.
+func calicoPeers(entity CalicoEntityRule, global bool) []networkingv1.NetworkPolicyPeer {
+	peers := []networkingv1.NetworkPolicyPeer{}
+	if entity.Selector != "" || entity.NamespaceSelector != "" {
+		peer := networkingv1.NetworkPolicyPeer{}
+		if entity.Selector != "" {
+			s := calicoSelector(entity.Selector)
+			peer.PodSelector = &s
+		}
+		if entity.NamespaceSelector != "" {
+			s := calicoSelector(entity.NamespaceSelector)
+			peer.NamespaceSelector = &s
+		} else if global {
+			peer.NamespaceSelector = &metav1.LabelSelector{}
+		}
+		peers = append(peers, peer)
+	}
+	for _, net := range entity.Nets {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: net}})
+	}
+	return peers
+}
+
+// calicoSelector converts a Calico selector expression into a label selector.
+// Expressions that are not a conjunction of equality, inequality, set and has
+// terms are kept whole as the value of a single match expression.
+func calicoSelector(expression string) metav1.LabelSelector {
+	expression = strings.TrimSpace(expression)
+	s := metav1.LabelSelector{}
+	if expression == "" || expression == "all()" {
+		return s
+	}
+	for _, term := range calicoSelectorTerm.Split(expression, -1) {
+		if !addCalicoTerm(&s, term) {
+			return metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      "selector",
+				Operator: calicoSelectorOperator,
+				Values:   []string{expression},
+			}}}
+		}
+	}
+	return s
+}
+
+// calicoExpression returns the Calico selector expression that a label
+// selector holds whole, if any.
+func calicoExpression(s metav1.LabelSelector) (string, bool) {
+	for _, requirement := range s.MatchExpressions {
+		if requirement.Operator == calicoSelectorOperator && len(requirement.Values) == 1 {
+			return requirement.Values[0], true
+		}
+	}
+	return "", false
+}
+
+// addCalicoTerm adds a term of a Calico selector expression to a label
+// selector and reports whether the term could be converted.
+func addCalicoTerm(s *metav1.LabelSelector, term string) bool {
+	if match := calicoEqualTerm.FindStringSubmatch(term); match != nil {
+		if match[2] == "!=" {
+			s.MatchExpressions = append(s.MatchExpressions, metav1.LabelSelectorRequirement{Key: match[1], Operator: metav1.LabelSelectorOpNotIn, Values: []string{match[3]}})
+			return true
+		}
+		if s.MatchLabels == nil {
+			s.MatchLabels = map[string]string{}
+		}
+		s.MatchLabels[match[1]] = match[3]
+		return true
+	}
+	if match := calicoHasTerm.FindStringSubmatch(term); match != nil {
+		operator := metav1.LabelSelectorOpExists
+		if match[1] == "!" {
+			operator = metav1.LabelSelectorOpDoesNotExist
+		}
+		s.MatchExpressions = append(s.MatchExpressions, metav1.LabelSelectorRequirement{Key: match[2], Operator: operator})
+		return true
+	}
+	if match := calicoInTerm.FindStringSubmatch(term); match != nil {
+		operator := metav1.LabelSelectorOpIn
+		if match[2] != "" {
+			operator = metav1.LabelSelectorOpNotIn
+		}
+		values := []string{}
+		for _, value := range strings.Split(match[3], ",") {
+			values = append(values, strings.Trim(strings.TrimSpace(value), `'"`))
+		}
+		s.MatchExpressions = append(s.MatchExpressions, metav1.LabelSelectorRequirement{Key: match[1], Operator: operator, Values: values})
+		return true
+	}
+	return false
+}
+
+// calicoPorts converts the protocol and destination ports of a rule into
+// network policy ports. No ports means all ports of the protocol.
+func calicoPorts(protocol *intstr.IntOrString, ports []intstr.IntOrString) []networkingv1.NetworkPolicyPort {
+	var p *corev1.Protocol
+	if protocol != nil {
+		value := corev1.Protocol(strings.ToUpper(protocol.String()))
+		p = &value
+	}
+	if len(ports) == 0 {
+		return []networkingv1.NetworkPolicyPort{{Protocol: p}}
+	}
+	result := []networkingv1.NetworkPolicyPort{}
+	for _, port := range ports {
+		value := port
+		np := networkingv1.NetworkPolicyPort{Protocol: p, Port: &value}
+		if first, last, isRange := strings.Cut(port.String(), ":"); isRange {
+			start, startErr := strconv.Atoi(first)
+			end, endErr := strconv.Atoi(last)
+			if startErr == nil && endErr == nil {
+				value = intstr.FromInt32(int32(start))
+				endPort := int32(end)
+				np.EndPort = &endPort
+			}
+		}
+		result = append(result, np)
+	}
+	return result
+}
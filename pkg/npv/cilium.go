@@ -0,0 +1,404 @@
+package npv
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// CiliumNetworkPolicyKind is the kind of namespaced Cilium policies.
+	CiliumNetworkPolicyKind = "CiliumNetworkPolicy"
+	// CiliumClusterwideNetworkPolicyKind is the kind of cluster wide Cilium
+	// policies.
+	CiliumClusterwideNetworkPolicyKind = "CiliumClusterwideNetworkPolicy"
+
+	// ciliumNamespaceLabel is the label Cilium gives endpoints for their
+	// namespace.
+	ciliumNamespaceLabel = "io.kubernetes.pod.namespace"
+	// ciliumNamespaceLabelsPrefix prefixes the labels Cilium gives endpoints
+	// for the labels of their namespace.
+	ciliumNamespaceLabelsPrefix = "io.cilium.k8s.namespace.labels."
+)
+
+var (
+	// CiliumNetworkPolicies is the resource of CiliumNetworkPolicy.
+	CiliumNetworkPolicies = schema.GroupVersionResource{Group: "cilium.io", Version: "v2", Resource: "ciliumnetworkpolicies"}
+	// CiliumClusterwideNetworkPolicies is the resource of
+	// CiliumClusterwideNetworkPolicy.
+	CiliumClusterwideNetworkPolicies = schema.GroupVersionResource{Group: "cilium.io", Version: "v2", Resource: "ciliumclusterwidenetworkpolicies"}
+)
+
+// CiliumNetworkPolicy is a cilium.io/v2 CiliumNetworkPolicy or
+// CiliumClusterwideNetworkPolicy. Only the fields npv draws are decoded.
+type CiliumNetworkPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              *CiliumRule  `json:"spec,omitempty"`
+	Specs             []CiliumRule `json:"specs,omitempty"`
+}
+
+// ClusterWide reports whether the policy is a CiliumClusterwideNetworkPolicy.
+func (p CiliumNetworkPolicy) ClusterWide() bool {
+	return p.Kind == CiliumClusterwideNetworkPolicyKind
+}
+
+// CiliumRule selects endpoints and lists the traffic they allow and deny. An
+// ingress or egress section that is present but allows nothing denies all
+// traffic in that direction. Deny rules take precedence over allow rules.
+type CiliumRule struct {
+	EndpointSelector metav1.LabelSelector `json:"endpointSelector"`
+	Ingress          []CiliumIngressRule  `json:"ingress,omitempty"`
+	IngressDeny      []CiliumIngressRule  `json:"ingressDeny,omitempty"`
+	Egress           []CiliumEgressRule   `json:"egress,omitempty"`
+	EgressDeny       []CiliumEgressRule   `json:"egressDeny,omitempty"`
+}
+
+// CiliumIngressRule allows, or denies, traffic from peers on ports.
+type CiliumIngressRule struct {
+	FromEndpoints []metav1.LabelSelector `json:"fromEndpoints,omitempty"`
+	FromCIDR      []string               `json:"fromCIDR,omitempty"`
+	FromCIDRSet   []CiliumCIDRRule       `json:"fromCIDRSet,omitempty"`
+	FromEntities  []string               `json:"fromEntities,omitempty"`
+	ToPorts       []CiliumPortRule       `json:"toPorts,omitempty"`
+}
+
+// CiliumEgressRule allows, or denies, traffic to peers on ports.
+type CiliumEgressRule struct {
+	ToEndpoints []metav1.LabelSelector `json:"toEndpoints,omitempty"`
+	ToCIDR      []string               `json:"toCIDR,omitempty"`
+	ToCIDRSet   []CiliumCIDRRule       `json:"toCIDRSet,omitempty"`
+	ToEntities  []string               `json:"toEntities,omitempty"`
+	ToFQDNs     []CiliumFQDNSelector   `json:"toFQDNs,omitempty"`
+	ToPorts     []CiliumPortRule       `json:"toPorts,omitempty"`
+}
+
+// CiliumCIDRRule is a CIDR with exceptions.
+type CiliumCIDRRule struct {
+	CIDR   string   `json:"cidr"`
+	Except []string `json:"except,omitempty"`
+}
+
+// CiliumFQDNSelector matches DNS names exactly or with * wildcards.
+type CiliumFQDNSelector struct {
+	MatchName    string `json:"matchName,omitempty"`
+	MatchPattern string `json:"matchPattern,omitempty"`
+}
+
+// CiliumPortRule lists the ports of a rule.
+type CiliumPortRule struct {
+	Ports []CiliumPortProtocol `json:"ports,omitempty"`
+}
+
+// CiliumPortProtocol is a port, or range of ports, and protocol. An empty
+// protocol is ANY.
+type CiliumPortProtocol struct {
+	Port     string `json:"port"`
+	EndPort  int32  `json:"endPort,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// LoadCiliumNamespaces returns the CiliumNetworkPolicies in the given
+// namespaces, or in all namespaces when none are given, and all
+// CiliumClusterwideNetworkPolicies. No policies are returned when Cilium is
+// not installed.
+func LoadCiliumNamespaces(ctx context.Context, client dynamic.Interface, namespaces []string) ([]CiliumNetworkPolicy, error) {
+	lists := []*unstructured.UnstructuredList{}
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		list, err := client.Resource(CiliumNetworkPolicies).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			return []CiliumNetworkPolicy{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	list, err := client.Resource(CiliumClusterwideNetworkPolicies).List(ctx, metav1.ListOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		lists = append(lists, list)
+	}
+	items := []CiliumNetworkPolicy{}
+	for _, list := range lists {
+		for _, item := range list.Items {
+			var policy CiliumNetworkPolicy
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &policy); err != nil {
+				return nil, err
+			}
+			items = append(items, policy)
+		}
+	}
+	return items, nil
+}
+
+// LoadCiliumFiles returns the CiliumNetworkPolicies and
+// CiliumClusterwideNetworkPolicies in the given files. Each file may be a glob
+// and may contain multiple YAML or JSON documents. Other kinds are ignored and
+// documents that cannot be decoded are returned as DecodeErrors, as with
+// LoadFiles.
+func LoadCiliumFiles(files []string) ([]CiliumNetworkPolicy, error) {
+	return loadFiles(files, (*Objects).CiliumPolicies)
+}
+
+// CiliumPolicies returns the CiliumNetworkPolicies and
+// CiliumClusterwideNetworkPolicies among the objects. Objects that cannot be
+// converted are returned as DecodeErrors along with the others.
+func (o *Objects) CiliumPolicies() ([]CiliumNetworkPolicy, error) {
+	items := []CiliumNetworkPolicy{}
+	err := o.each(func(obj *unstructured.Unstructured) error {
+		if obj.GetKind() != CiliumNetworkPolicyKind && obj.GetKind() != CiliumClusterwideNetworkPolicyKind {
+			return nil
+		}
+		var policy CiliumNetworkPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+			return err
+		}
+		items = append(items, policy)
+		return nil
+	})
+	return items, err
+}
+
+// AddCiliumPolicies adds the pods selected by Cilium policies, and the peers
+// they exchange traffic with, to the model. Endpoint selectors become pod and
+// namespace selectors, CIDRs become IP blocks and entities and DNS names
+// become peers of their own. Deny rules become targets with the Deny action.
+func (m *Model) AddCiliumPolicies(policies []CiliumNetworkPolicy) {
+	for _, policy := range policies {
+		rules := policy.Specs
+		if policy.Spec != nil {
+			rules = append([]CiliumRule{*policy.Spec}, rules...)
+		}
+		for _, rule := range rules {
+			selector := ciliumSelector(rule.EndpointSelector)
+			key := podKey(policy.Namespace, selector)
+			if policy.ClusterWide() {
+				key = "_CLUSTER_" + podKey("", selector)
+			}
+			p, present := m.pods[key]
+			if !present {
+				p = pod{
+					id:          key,
+					namespace:   policy.Namespace,
+					selector:    selector,
+					clusterWide: policy.ClusterWide(),
+				}
+			}
+			name := policy.Kind + "/" + policy.Name
+			if !slices.Contains(p.names, name) {
+				p.names = append(p.names, name)
+			}
+			if rule.Ingress != nil {
+				targets := []target{}
+				for _, ingress := range rule.Ingress {
+					peers := ciliumPeers(ingress.FromEndpoints, ingress.FromCIDR, ingress.FromCIDRSet, policy.ClusterWide())
+					targets = append(targets, ciliumTargets(peers, ingress.FromEntities, nil, ingress.ToPorts)...)
+				}
+				if len(targets) == 0 {
+					targets = append(targets, target{id: p.id + "_ALL_", peerId: "_ALL_PEER_INGRESS_", blockAll: true})
+				}
+				p.ingress = append(p.ingress, targets...)
+			}
+			if rule.Egress != nil {
+				targets := []target{}
+				for _, egress := range rule.Egress {
+					peers := ciliumPeers(egress.ToEndpoints, egress.ToCIDR, egress.ToCIDRSet, policy.ClusterWide())
+					targets = append(targets, ciliumTargets(peers, egress.ToEntities, egress.ToFQDNs, egress.ToPorts)...)
+				}
+				if len(targets) == 0 {
+					targets = append(targets, target{id: p.id + "_ALL_", peerId: "_ALL_PEER_EGRESS_", blockAll: true})
+				}
+				p.egress = append(p.egress, targets...)
+			}
+			for _, ingress := range rule.IngressDeny {
+				peers := ciliumPeers(ingress.FromEndpoints, ingress.FromCIDR, ingress.FromCIDRSet, policy.ClusterWide())
+				p.ingress = append(p.ingress, ciliumDenyTargets(ciliumTargets(peers, ingress.FromEntities, nil, ingress.ToPorts))...)
+			}
+			for _, egress := range rule.EgressDeny {
+				peers := ciliumPeers(egress.ToEndpoints, egress.ToCIDR, egress.ToCIDRSet, policy.ClusterWide())
+				p.egress = append(p.egress, ciliumDenyTargets(ciliumTargets(peers, egress.ToEntities, nil, egress.ToPorts))...)
+			}
+			m.pods[key] = p
+		}
+	}
+	m.pods = sorted(m.pods)
+}
+
+// ciliumTargets returns a target for every combination of peer and port. A
+// rule that only lists ports allows every peer on those ports.
+func ciliumTargets(peers []networkingv1.NetworkPolicyPeer, entities []string, fqdns []CiliumFQDNSelector, portRules []CiliumPortRule) []target {
+	templates := []target{}
+	for _, peer := range peers {
+		templates = append(templates, target{peerId: peerID(peer), peer: peer})
+	}
+	for _, entity := range entities {
+		templates = append(templates, target{peerId: "_ENTITY_" + normalizePlantUMLId(entity), entity: entity})
+	}
+	for _, fqdn := range fqdns {
+		name := fqdn.MatchName
+		if fqdn.MatchPattern != "" {
+			name = fqdn.MatchPattern
+		}
+		templates = append(templates, target{peerId: fqdnPeerID(name), fqdn: name})
+	}
+	ports := ciliumPorts(portRules)
+	if len(templates) == 0 {
+		if len(portRules) == 0 {
+			return nil
+		}
+		templates = append(templates, target{peerId: "_ENTITY_all", entity: "all"})
+	}
+	targets := []target{}
+	for _, template := range templates {
+		for _, port := range ports {
+			t := template
+			t.port = port
+			t.id = peerTargetKey(t.peerId, port)
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// ciliumDenyTargets marks the targets of deny rules.
+func ciliumDenyTargets(targets []target) []target {
+	for i := range targets {
+		targets[i].action = Deny
+		targets[i].id += "_" + string(Deny)
+	}
+	return targets
+}
+
+func ciliumPeers(endpoints []metav1.LabelSelector, cidrs []string, cidrSets []CiliumCIDRRule, clusterWide bool) []networkingv1.NetworkPolicyPeer {
+	peers := []networkingv1.NetworkPolicyPeer{}
+	for _, endpoint := range endpoints {
+		peers = append(peers, ciliumEndpointPeer(endpoint, clusterWide))
+	}
+	for _, cidr := range cidrs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+	for _, cidrSet := range cidrSets {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidrSet.CIDR, Except: cidrSet.Except}})
+	}
+	return peers
+}
+
+// ciliumEndpointPeer converts an endpoint selector into a peer. The namespace
+// labels Cilium adds to endpoints become a namespace selector. Endpoint
+// selectors of namespaced policies without namespace labels only select
+// endpoints in the policy's namespace, like pod selectors of network policies,
+// while those of cluster wide policies select endpoints in every namespace.
+func ciliumEndpointPeer(s metav1.LabelSelector, clusterWide bool) networkingv1.NetworkPolicyPeer {
+	s = ciliumSelector(s)
+	pods := metav1.LabelSelector{}
+	namespaces := metav1.LabelSelector{}
+	namespaced := false
+	namespaceKey := func(key string) (string, bool) {
+		if key == ciliumNamespaceLabel {
+			return corev1.LabelMetadataName, true
+		}
+		if strings.HasPrefix(key, ciliumNamespaceLabelsPrefix) {
+			return strings.TrimPrefix(key, ciliumNamespaceLabelsPrefix), true
+		}
+		return key, false
+	}
+	for k, v := range s.MatchLabels {
+		if key, isNamespace := namespaceKey(k); isNamespace {
+			if namespaces.MatchLabels == nil {
+				namespaces.MatchLabels = map[string]string{}
+			}
+			namespaces.MatchLabels[key] = v
+			namespaced = true
+			continue
+		}
+		if pods.MatchLabels == nil {
+			pods.MatchLabels = map[string]string{}
+		}
+		pods.MatchLabels[k] = v
+	}
+	for _, e := range s.MatchExpressions {
+		if key, isNamespace := namespaceKey(e.Key); isNamespace {
+			e.Key = key
+			namespaces.MatchExpressions = append(namespaces.MatchExpressions, e)
+			namespaced = true
+			continue
+		}
+		pods.MatchExpressions = append(pods.MatchExpressions, e)
+	}
+	peer := networkingv1.NetworkPolicyPeer{PodSelector: &pods}
+	if namespaced || clusterWide {
+		peer.NamespaceSelector = &namespaces
+	}
+	return peer
+}
+
+// ciliumSelector removes the source prefixes, such as k8s:, from the keys of
+// a selector.
+func ciliumSelector(s metav1.LabelSelector) metav1.LabelSelector {
+	key := func(k string) string {
+		for _, source := range []string{"k8s:", "any:"} {
+			k = strings.TrimPrefix(k, source)
+		}
+		return k
+	}
+	result := metav1.LabelSelector{}
+	for k, v := range s.MatchLabels {
+		if result.MatchLabels == nil {
+			result.MatchLabels = map[string]string{}
+		}
+		result.MatchLabels[key(k)] = v
+	}
+	for _, e := range s.MatchExpressions {
+		e.Key = key(e.Key)
+		result.MatchExpressions = append(result.MatchExpressions, e)
+	}
+	return result
+}
+
+// ciliumPorts converts port rules into network policy ports. Protocols are
+// always set so that ANY is shown. No rules means all ports.
+func ciliumPorts(rules []CiliumPortRule) []networkingv1.NetworkPolicyPort {
+	ports := []networkingv1.NetworkPolicyPort{}
+	for _, rule := range rules {
+		for _, p := range rule.Ports {
+			protocol := corev1.Protocol(strings.ToUpper(p.Protocol))
+			if protocol == "" {
+				protocol = "ANY"
+			}
+			port := networkingv1.NetworkPolicyPort{Protocol: &protocol}
+			if p.Port != "" && p.Port != "0" {
+				value := intstr.FromString(p.Port)
+				if number, err := strconv.Atoi(p.Port); err == nil {
+					value = intstr.FromInt32(int32(number))
+				}
+				port.Port = &value
+			}
+			if p.EndPort > 0 {
+				endPort := p.EndPort
+				port.EndPort = &endPort
+			}
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		ports = append(ports, networkingv1.NetworkPolicyPort{})
+	}
+	return ports
+}
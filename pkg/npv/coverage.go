@@ -0,0 +1,104 @@
+package npv
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// Coverage reports which namespaces and pods are isolated by network policies.
+type Coverage struct {
+	Namespaces []NamespaceCoverage `json:"namespaces"`
+	Pods       []PodCoverage       `json:"pods"`
+}
+
+// NamespaceCoverage lists the policies of a namespace that select every pod in
+// it, such as default deny policies.
+type NamespaceCoverage struct {
+	Name string `json:"name"`
+	// Ingress holds the policies that isolate all pods for ingress.
+	Ingress []string `json:"ingress"`
+	// Egress holds the policies that isolate all pods for egress.
+	Egress []string `json:"egress"`
+}
+
+// PodCoverage lists the policies that isolate a pod. A pod is not isolated,
+// and allows all traffic, in a direction for which no policy selects it.
+type PodCoverage struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Ingress holds the policies that select the pod for ingress.
+	Ingress []string `json:"ingress"`
+	// Egress holds the policies that select the pod for egress.
+	Egress []string `json:"egress"`
+}
+
+// NewCoverage determines which of the given workloads are selected by the
+// given policies. Namespaces of pods are included even when the workloads do
+// not contain the Namespace itself. Completed pods are ignored.
+func NewCoverage(policies []networkingv1.NetworkPolicy, w *Workloads) *Coverage {
+	c := &Coverage{
+		Namespaces: []NamespaceCoverage{},
+		Pods:       []PodCoverage{},
+	}
+	namespaces := map[string]NamespaceCoverage{}
+	for _, namespace := range w.Namespaces {
+		namespaces[namespace.Name] = NamespaceCoverage{Name: namespace.Name, Ingress: []string{}, Egress: []string{}}
+	}
+	pods := slices.Clone(w.Pods)
+	slices.SortFunc(pods, func(l, r corev1.Pod) int {
+		if c := strings.Compare(l.Namespace, r.Namespace); c != 0 {
+			return c
+		}
+		return strings.Compare(l.Name, r.Name)
+	})
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if _, present := namespaces[pod.Namespace]; !present {
+			namespaces[pod.Namespace] = NamespaceCoverage{Name: pod.Namespace, Ingress: []string{}, Egress: []string{}}
+		}
+		p := PodCoverage{Namespace: pod.Namespace, Name: pod.Name, Ingress: []string{}, Egress: []string{}}
+		endpoint := Endpoint{Namespace: pod.Namespace, Labels: pod.Labels}
+		for _, policy := range policies {
+			if !selectsPod(policy, endpoint) {
+				continue
+			}
+			types := effectivePolicyTypes(policy)
+			if slices.Contains(types, networkingv1.PolicyTypeIngress) {
+				p.Ingress = append(p.Ingress, policy.Name)
+			}
+			if slices.Contains(types, networkingv1.PolicyTypeEgress) {
+				p.Egress = append(p.Egress, policy.Name)
+			}
+		}
+		slices.Sort(p.Ingress)
+		slices.Sort(p.Egress)
+		c.Pods = append(c.Pods, p)
+	}
+	for _, policy := range policies {
+		namespace, present := namespaces[policy.Namespace]
+		if !present || len(policy.Spec.PodSelector.MatchLabels) > 0 || len(policy.Spec.PodSelector.MatchExpressions) > 0 {
+			continue
+		}
+		types := effectivePolicyTypes(policy)
+		if slices.Contains(types, networkingv1.PolicyTypeIngress) {
+			namespace.Ingress = append(namespace.Ingress, policy.Name)
+		}
+		if slices.Contains(types, networkingv1.PolicyTypeEgress) {
+			namespace.Egress = append(namespace.Egress, policy.Name)
+		}
+		namespaces[policy.Namespace] = namespace
+	}
+	for _, name := range maputils.SortedKeys(namespaces) {
+		namespace := namespaces[name]
+		slices.Sort(namespace.Ingress)
+		slices.Sort(namespace.Egress)
+		c.Namespaces = append(c.Namespaces, namespace)
+	}
+	return c
+}
@@ -0,0 +1,300 @@
+package npv
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// yamlErrorLine finds the line, relative to the document, in the errors of the
+// YAML parser.
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// DecodeError is a document of a file that could not be decoded.
+type DecodeError struct {
+	// File is the path of the file, or <stdin>.
+	File string
+	// Document is the position of the document in the file, starting at 1.
+	Document int
+	// Line is the line of the error in the file when known, or else the
+	// first line of the document.
+	Line int
+	// Err is the error of the decoder.
+	Err error
+	// position orders the documents of all the manifests decoded together.
+	position int
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: document %d, line %d: %s", e.File, e.Document, e.Line, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeErrors lists every document of the files given to a loader that could
+// not be decoded. Loaders return it along with the objects of the documents
+// that could be decoded.
+type DecodeErrors []*DecodeError
+
+func (e DecodeErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// DecodeErrorHandler returns a function that handles the errors of loaders
+// reading the same files. When keepGoing is false errors are returned as is.
+// Otherwise the documents listed by a DecodeErrors error are written to w as
+// warnings, once each however many loaders return them, and nil is returned
+// so that callers can go on with the documents that could be decoded. Other
+// errors are always returned.
+func DecodeErrorHandler(w io.Writer, keepGoing bool) func(error) error {
+	reported := map[string]bool{}
+	return func(err error) error {
+		var decodeErrors DecodeErrors
+		if !keepGoing || !errors.As(err, &decodeErrors) {
+			return err
+		}
+		for _, e := range decodeErrors {
+			if !reported[e.Error()] {
+				reported[e.Error()] = true
+				fmt.Fprintln(w, "warning: "+e.Error())
+			}
+		}
+		return nil
+	}
+}
+
+// joinDecodeErrors returns the documents listed by the DecodeErrors errors
+// as one DecodeErrors error, or nil when there are none. Other errors are
+// ignored.
+func joinDecodeErrors(errs ...error) error {
+	joined := DecodeErrors{}
+	for _, err := range errs {
+		var decodeErrors DecodeErrors
+		if errors.As(err, &decodeErrors) {
+			joined = append(joined, decodeErrors...)
+		}
+	}
+	if len(joined) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(joined, func(a, b *DecodeError) int {
+		return cmp.Compare(a.position, b.position)
+	})
+	return joined
+}
+
+// document is a YAML or JSON document of a file.
+type document struct {
+	// index is the position of the document in the file, starting at 1.
+	index int
+	// line is the first line of the document in the file.
+	line int
+	// position orders the documents of all the manifests decoded together.
+	position int
+	contents []byte
+	// err is set when the document could not be separated from the rest of
+	// the file, such as invalid JSON.
+	err error
+}
+
+// splitDocuments splits the contents of a file into documents. Files that
+// start with { or [ are read as a stream of JSON values and others as YAML
+// documents separated by ---. Empty documents are skipped.
+func splitDocuments(contents []byte) []document {
+	trimmed := bytes.TrimSpace(contents)
+	if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		return splitJSON(contents)
+	}
+	return splitYAML(contents)
+}
+
+func splitYAML(contents []byte) []document {
+	documents := []document{}
+	lines := strings.SplitAfter(string(contents), "\n")
+	start := 0
+	flush := func(end int) {
+		text := strings.Join(lines[start:end], "")
+		if !emptyYAML(text) {
+			documents = append(documents, document{index: len(documents) + 1, line: start + 1, contents: []byte(text)})
+		}
+	}
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "---" || strings.HasPrefix(trimmed, "--- ") {
+			flush(i)
+			start = i + 1
+		}
+	}
+	flush(len(lines))
+	return documents
+}
+
+// emptyYAML reports whether a YAML document only holds blank lines and
+// comments.
+func emptyYAML(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+func splitJSON(contents []byte) []document {
+	documents := []document{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	for {
+		offset := decoder.InputOffset()
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		// The value starts after the whitespace preceding it.
+		start := int(offset) + len(contents[offset:]) - len(bytes.TrimLeft(contents[offset:], " \t\r\n"))
+		d := document{index: len(documents) + 1, line: lineAt(contents, start), contents: raw}
+		if err != nil {
+			var syntaxError *json.SyntaxError
+			if errors.As(err, &syntaxError) {
+				d.line = lineAt(contents, int(syntaxError.Offset))
+			}
+			d.err = err
+			// The rest of the stream cannot be read after a syntax error.
+			return append(documents, d)
+		}
+		documents = append(documents, d)
+	}
+	return documents
+}
+
+// lineAt returns the line of an offset in contents.
+func lineAt(contents []byte, offset int) int {
+	offset = min(offset, len(contents))
+	return bytes.Count(contents[:offset], []byte("\n")) + 1
+}
+
+// decode returns the object of a document. Documents that only hold null
+// return nil.
+func (d document) decode() (*unstructured.Unstructured, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(d.contents, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, nil
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+// decodeError returns the DecodeError of the document of a manifest. The
+// line of the error in the manifest is used when known.
+func (d document) decodeError(manifest string, err error) *DecodeError {
+	line := d.line
+	if d.err == nil {
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			relative, _ := strconv.Atoi(match[1])
+			line = d.line + relative - 1
+		}
+	}
+	return &DecodeError{File: manifest, Document: d.index, Line: line, Err: err, position: d.position}
+}
+
+// Objects are the objects of a set of manifests. Manifests are decoded once
+// and every loader, such as NetworkPolicies or CiliumPolicies, selects the
+// objects of its kinds among them.
+type Objects struct {
+	objects []decodedObject
+}
+
+// decodedObject is an object along with the manifest and document it was decoded
+// from, so that loaders can report the objects they cannot convert.
+type decodedObject struct {
+	*unstructured.Unstructured
+	manifest string
+	document document
+}
+
+// DecodeManifests decodes the objects of the manifests. Each manifest may
+// contain multiple YAML or JSON documents and lists are unwrapped. Documents
+// that cannot be decoded are skipped and returned as DecodeErrors along with
+// the objects of the others.
+func DecodeManifests(manifests []Manifest) (*Objects, error) {
+	o := &Objects{}
+	decodeErrors := DecodeErrors{}
+	position := 0
+	for _, m := range manifests {
+		for _, d := range splitDocuments(m.Contents) {
+			position++
+			d.position = position
+			obj, err := d.decode()
+			if err == nil && obj != nil {
+				err = eachListItem(obj, func(item *unstructured.Unstructured) error {
+					o.objects = append(o.objects, decodedObject{Unstructured: item, manifest: m.Name, document: d})
+					return nil
+				})
+			}
+			if err != nil {
+				decodeErrors = append(decodeErrors, d.decodeError(m.Name, err))
+			}
+		}
+	}
+	if len(decodeErrors) > 0 {
+		return o, decodeErrors
+	}
+	return o, nil
+}
+
+// each calls add with every object. Objects that add rejects are skipped and
+// returned as DecodeErrors.
+func (o *Objects) each(add func(*unstructured.Unstructured) error) error {
+	decodeErrors := DecodeErrors{}
+	for _, obj := range o.objects {
+		if err := add(obj.Unstructured); err != nil {
+			decodeErrors = append(decodeErrors, obj.document.decodeError(obj.manifest, err))
+		}
+	}
+	if len(decodeErrors) > 0 {
+		return decodeErrors
+	}
+	return nil
+}
+
+// loadFiles reads the files named by the given arguments, as described by
+// ExpandFiles, with Stdin read from standard input, decodes their objects and
+// returns those load selects. The documents that cannot be decoded and the
+// objects that load cannot convert are returned together as DecodeErrors.
+func loadFiles[T any](files []string, load func(*Objects) (T, error)) (T, error) {
+	var items T
+	paths, err := ExpandFiles(files, nil, nil)
+	if err != nil {
+		return items, err
+	}
+	manifests, err := ReadFiles(paths, os.Stdin)
+	if err != nil {
+		return items, err
+	}
+	objects, decodeErr := DecodeManifests(manifests)
+	items, loadErr := load(objects)
+	return items, joinDecodeErrors(decodeErr, loadErr)
+}
@@ -0,0 +1,182 @@
+package npv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+)
+
+// ChangeType classifies a Change.
+type ChangeType string
+
+const (
+	// Added means the peer is only present in the new model.
+	Added ChangeType = "added"
+	// Removed means the peer is only present in the old model.
+	Removed ChangeType = "removed"
+	// Changed means the peer is present in both models with different
+	// ports.
+	Changed ChangeType = "changed"
+)
+
+// Change is a difference in the traffic a pod group may exchange with a peer.
+type Change struct {
+	Type ChangeType `json:"type"`
+	// Pod describes the pod group.
+	Pod string `json:"pod"`
+	// Direction is ingress or egress.
+	Direction string `json:"direction"`
+	// Peer describes the peer.
+	Peer string `json:"peer"`
+	// OldPorts holds the ports allowed in the old model.
+	OldPorts []string `json:"oldPorts"`
+	// NewPorts holds the ports allowed in the new model.
+	NewPorts []string `json:"newPorts"`
+}
+
+// Diff is the difference between two models.
+type Diff struct {
+	Changes []Change
+	model   *Model
+}
+
+// NewDiff compares two models.
+func NewDiff(old, new *Model) *Diff {
+	d := &Diff{
+		Changes: []Change{},
+		model:   &Model{pods: map[string]pod{}},
+	}
+	ids := maputils.Keys(old.pods)
+	for id := range new.pods {
+		if _, present := old.pods[id]; !present {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		oldPod, inOld := old.pods[id]
+		newPod, inNew := new.pods[id]
+		merged := newPod
+		if !inNew {
+			merged = oldPod
+		}
+		merged.ingress = d.compare(merged, "ingress", oldPod.ingress, newPod.ingress)
+		merged.egress = d.compare(merged, "egress", oldPod.egress, newPod.egress)
+		if inOld && inNew {
+			merged.names = slices.Compact(slices.Sorted(slices.Values(append(slices.Clone(oldPod.names), newPod.names...))))
+		}
+		d.model.pods[id] = merged
+	}
+	return d
+}
+
+// Model returns the union of both models. Targets only present in one of the
+// models are marked so that renderers can highlight added and removed edges.
+func (d *Diff) Model() *Model {
+	return d.model
+}
+
+// compare records the changes between the old and new targets of a pod group
+// in one direction and returns the union of the targets.
+func (d *Diff) compare(p pod, direction string, old, new []target) []target {
+	merged := []target{}
+	oldPorts := map[string][]string{}
+	newPorts := map[string][]string{}
+	peers := map[string]target{}
+	for _, t := range old {
+		oldPorts[t.peerId] = append(oldPorts[t.peerId], edgeLabel(t))
+		peers[t.peerId] = t
+		if !slices.ContainsFunc(new, func(n target) bool { return n.id == t.id }) {
+			t.change = Removed
+		}
+		merged = append(merged, t)
+	}
+	for _, t := range new {
+		newPorts[t.peerId] = append(newPorts[t.peerId], edgeLabel(t))
+		peers[t.peerId] = t
+		if !slices.ContainsFunc(old, func(o target) bool { return o.id == t.id }) {
+			t.change = Added
+			merged = append(merged, t)
+		}
+	}
+	for _, peerId := range maputils.SortedKeys(peers) {
+		c := Change{
+			Pod:       p.namespace + ": " + selectorSummary(p.selector),
+			Direction: direction,
+			Peer:      targetSummary(peers[peerId]),
+			OldPorts:  slices.Compact(slices.Sorted(slices.Values(oldPorts[peerId]))),
+			NewPorts:  slices.Compact(slices.Sorted(slices.Values(newPorts[peerId]))),
+		}
+		switch {
+		case len(c.OldPorts) == 0:
+			c.Type = Added
+		case len(c.NewPorts) == 0:
+			c.Type = Removed
+		case !slices.Equal(c.OldPorts, c.NewPorts):
+			c.Type = Changed
+		default:
+			continue
+		}
+		if c.OldPorts == nil {
+			c.OldPorts = []string{}
+		}
+		if c.NewPorts == nil {
+			c.NewPorts = []string{}
+		}
+		d.Changes = append(d.Changes, c)
+	}
+	slices.SortFunc(merged, compareTarget)
+	return merged
+}
+
+// Text describes the changes in the given directions, grouped by pod group.
+func (d *Diff) Text(options RenderOptions) string {
+	categories := options.categories()
+	b := strings.Builder{}
+	current := ""
+	for _, c := range d.Changes {
+		if !slices.Contains(categories, c.Direction) {
+			continue
+		}
+		if c.Pod != current {
+			b.WriteString(c.Pod + "\n")
+			current = c.Pod
+		}
+		peer := "from " + c.Peer
+		if c.Direction == "egress" {
+			peer = "to " + c.Peer
+		}
+		switch c.Type {
+		case Added:
+			b.WriteString(fmt.Sprintf("  + %s %s: %s\n", c.Direction, peer, strings.Join(c.NewPorts, ", ")))
+		case Removed:
+			b.WriteString(fmt.Sprintf("  - %s %s: %s\n", c.Direction, peer, strings.Join(c.OldPorts, ", ")))
+		case Changed:
+			b.WriteString(fmt.Sprintf("  ~ %s %s: %s -> %s\n", c.Direction, peer, strings.Join(c.OldPorts, ", "), strings.Join(c.NewPorts, ", ")))
+		}
+	}
+	if b.Len() == 0 {
+		return "No changes\n"
+	}
+	return b.String()
+}
+
+// Render formats the diff as text, or as a PlantUML or DOT diagram of the
+// union of both models in which added edges are highlighted and removed edges
+// are dashed. An empty format selects text.
+func (d *Diff) Render(format string, options RenderOptions) (string, error) {
+	switch format {
+	case "", "text":
+		return d.Text(options), nil
+	case "plantuml", "dot":
+		renderer, err := RendererFor(format)
+		if err != nil {
+			return "", err
+		}
+		return renderer.Render(d.model, options)
+	default:
+		return "", fmt.Errorf("unsupported format: %s", format)
+	}
+}
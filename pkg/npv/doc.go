@@ -0,0 +1,11 @@
+// Package npv builds a model of the pods and peers described by Kubernetes
+// network policies and renders it as PlantUML, Graphviz DOT, Mermaid, SVG,
+// JSON or an interactive HTML report.
+//
+// Policies are loaded with LoadFiles or LoadNamespaces, turned into a Model
+// with NewModel and rendered with a Renderer obtained from RendererFor or with
+// any other implementation of Renderer. Cilium, Calico and admin network
+// policies are added to a Model with Model.AddCiliumPolicies,
+// Model.AddCalicoPolicies and Model.AddAdminPolicies, and Istio authorization
+// policies are overlaid with Model.AddIstioPolicies.
+package npv
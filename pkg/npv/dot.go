@@ -0,0 +1,144 @@
+package npv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+)
+
+func generatePodDOT(ids []string, pods map[string]pod, categories []string) string {
+	b := strings.Builder{}
+	for _, tier := range podTiers {
+		tierIds := tierPods(ids, pods, tier.tier, categories)
+		if tier.tier != "" && len(tierIds) == 0 {
+			continue
+		}
+		b.WriteString("    subgraph cluster_" + tier.id + " {\n")
+		b.WriteString("        label=\"" + tier.title + "\";\n")
+		for _, id := range tierIds {
+			pod := pods[id]
+			b.WriteString(fmt.Sprintf("        %s [label=\"%s\"];\n", quoteDOT(id), labelDOT(pod.Label())))
+		}
+		b.WriteString("    }\n")
+	}
+	return b.String()
+}
+
+func generateIngressDOT(ids []string, pods map[string]pod) string {
+	b := strings.Builder{}
+	ingressNodes := map[string]struct{}{}
+	b.WriteString("    subgraph cluster_ingress {\n")
+	b.WriteString("        label=\"Ingress\";\n")
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.ingress {
+			_, present := ingressNodes[t.peerId]
+			if !present {
+				b.WriteString(fmt.Sprintf("        %s [label=\"%s\"%s];\n", quoteDOT(t.peerId+"_i"), labelDOT(t.Label()), styleDOT(t)))
+				ingressNodes[t.peerId] = struct{}{}
+			}
+		}
+	}
+	b.WriteString("    }\n")
+	// Create edges to connect ingress to pods.
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.ingress {
+			b.WriteString(edgeDOT(t.peerId+"_i", id, t))
+		}
+	}
+	return b.String()
+}
+
+func generateEgressDOT(ids []string, pods map[string]pod) string {
+	b := strings.Builder{}
+	egressNodes := map[string]string{}
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.egress {
+			if _, present := egressNodes[t.peerId]; !present {
+				egressNodes[t.peerId] = fmt.Sprintf("        %s [label=\"%s\"%s];\n", quoteDOT(t.peerId+"_e"), labelDOT(t.Label()), styleDOT(t))
+			}
+		}
+	}
+	b.WriteString("    subgraph cluster_egress {\n")
+	b.WriteString("        label=\"Egress\";\n")
+	for _, peerId := range maputils.SortedKeys(egressNodes) {
+		b.WriteString(egressNodes[peerId])
+	}
+	b.WriteString("    }\n")
+	// Create edges to connect pods to egress.
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.egress {
+			b.WriteString(edgeDOT(id, t.peerId+"_e", t))
+		}
+	}
+	return b.String()
+}
+
+func generateDOT(
+	pods map[string]pod,
+	categories []string,
+) string {
+	b := strings.Builder{}
+	b.WriteString("digraph npv {\n")
+	b.WriteString("    rankdir=LR;\n")
+	b.WriteString("    node [shape=box, fontname=\"monospace\"];\n")
+	ids := maputils.SortedKeys(pods)
+	// Create the nodes that represent the pods.
+	b.WriteString(generatePodDOT(ids, pods, categories))
+	// Create nodes to represent all the ingress peers
+	if slices.Contains(categories, "ingress") {
+		b.WriteString(generateIngressDOT(ids, pods))
+	}
+	// Create nodes to represent all the egress peers
+	if slices.Contains(categories, "egress") {
+		b.WriteString(generateEgressDOT(ids, pods))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func edgeDOT(from, to string, t target) string {
+	color := edgeColor(t)
+	// Added targets of a diff are highlighted and removed targets are dashed.
+	switch t.change {
+	case Added:
+		color = "blue, style=bold"
+	case Removed:
+		color += ", style=dashed"
+	}
+	return fmt.Sprintf("    %s -> %s [color=%s, label=\"%s\"];\n", quoteDOT(from), quoteDOT(to), color, escapeDOT(edgeLabel(t)))
+}
+
+// styleDOT returns the attributes of the node of a peer that is drawn in a
+// style of its own.
+func styleDOT(t target) string {
+	switch t.peerStyle() {
+	case "entity":
+		return ", style=filled, fillcolor=lightblue"
+	case "fqdn":
+		return ", style=filled, fillcolor=khaki"
+	case "mesh":
+		return ", style=filled, fillcolor=lavender"
+	default:
+		return ""
+	}
+}
+
+// labelDOT converts a multi-line label into a left justified DOT label.
+func labelDOT(label string) string {
+	return strings.ReplaceAll(escapeDOT(label), "\n", "\\l")
+}
+
+func escapeDOT(v string) string {
+	v = strings.ReplaceAll(v, "\\", "\\\\")
+	return strings.ReplaceAll(v, "\"", "\\\"")
+}
+
+func quoteDOT(id string) string {
+	return "\"" + escapeDOT(id) + "\""
+}
@@ -0,0 +1,158 @@
+package npv
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Stdin is the file name that reads standard input.
+const Stdin = "-"
+
+// inputExtensions are the extensions of the files read from directories.
+var inputExtensions = []string{".yaml", ".yml", ".json"}
+
+// Manifest is a file of YAML or JSON documents, read from disk or produced in
+// memory, such as by rendering a Helm chart.
+type Manifest struct {
+	// Name identifies the manifest in errors, such as its path or <stdin>.
+	Name     string
+	Contents []byte
+}
+
+// ExpandFiles returns the files named by the given arguments. Stdin is
+// returned as is. Other arguments may be globs, and directories are walked
+// recursively for .yaml, .yml and .json files, skipping hidden directories.
+// When include patterns are given only files matching one of them are
+// returned, whatever their extension, and files and directories matching an
+// exclude pattern are skipped. Patterns without a separator match base names
+// and others match paths relative to the directory being walked, or the
+// argument for files given directly.
+func ExpandFiles(files, include, exclude []string) ([]string, error) {
+	for _, pattern := range append(slices.Clone(include), exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	result := []string{}
+	for _, file := range files {
+		if file == Stdin {
+			result = append(result, file)
+			continue
+		}
+		matches, err := filepath.Glob(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				if selectFile(match, include, exclude) {
+					result = append(result, match)
+				}
+				continue
+			}
+			walked, err := walkDirectory(match, include, exclude)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, walked...)
+		}
+	}
+	return result, nil
+}
+
+// walkDirectory returns the input files in a directory and its
+// subdirectories in lexical order.
+func walkDirectory(root string, include, exclude []string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") || matchesAny(relative, exclude) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(include) == 0 && !slices.Contains(inputExtensions, strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		if selectFile(relative, include, exclude) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// selectFile reports whether a file passes the include and exclude patterns.
+func selectFile(relative string, include, exclude []string) bool {
+	if len(include) > 0 && !matchesAny(relative, include) {
+		return false
+	}
+	return !matchesAny(relative, exclude)
+}
+
+// matchesAny reports whether a relative path matches one of the patterns.
+// Patterns without a separator are matched against the base name.
+func matchesAny(relative string, patterns []string) bool {
+	relative = filepath.ToSlash(relative)
+	for _, pattern := range patterns {
+		name := relative
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(relative)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFiles reads the given files, such as those returned by ExpandFiles,
+// which are not expanded again. Stdin is read from stdin, at most once however
+// many times it is given, and named <stdin>.
+func ReadFiles(files []string, stdin io.Reader) ([]Manifest, error) {
+	manifests := []Manifest{}
+	var stdinContents []byte
+	stdinRead := false
+	for _, file := range files {
+		var contents []byte
+		var err error
+		name := file
+		if file == Stdin {
+			if !stdinRead {
+				stdinContents, err = io.ReadAll(stdin)
+				stdinRead = true
+			}
+			contents = stdinContents
+			name = "<stdin>"
+		} else {
+			contents, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, Manifest{Name: name, Contents: contents})
+	}
+	return manifests, nil
+}
@@ -0,0 +1,159 @@
+package npv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ReadRevision reads files at a revision, such as main, v1.2 or a commit
+// hash, of the git repository holding the working directory. Blobs are read
+// from the repository and nothing is checked out or written. The paths are
+// relative to the working directory and are selected as ExpandFiles selects
+// them in the working tree: files named by a path are always read, and
+// directories are walked for .yaml, .yml and .json files, skipping hidden
+// directories, with the include and exclude patterns applied. Stdin is read
+// from stdin as ReadFiles does.
+//
+// The manifests are named by the revision and their slash separated path
+// relative to the root of the repository, such as main:policies/web.yaml.
+func ReadRevision(revision string, paths, include, exclude []string, stdin io.Reader) ([]Manifest, error) {
+	for _, pattern := range append(slices.Clone(include), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	repository, err := git.PlainOpenWithOptions(wd, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", wd, err)
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	root := worktree.Filesystem.Root()
+	// The working directory may be reached through a symlink that the root
+	// of the repository is not.
+	if resolved, err := filepath.EvalSymlinks(wd); err == nil {
+		wd = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	rooted := []string{}
+	for _, p := range paths {
+		if p == Stdin {
+			rooted = append(rooted, p)
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(wd, p)
+		}
+		relative, err := filepath.Rel(root, p)
+		if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is outside of the repository in %s", p, root)
+		}
+		rooted = append(rooted, filepath.ToSlash(relative))
+	}
+	hash, err := repository.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", revision, err)
+	}
+	commit, err := repository.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	files := []*object.File{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if f.Mode != filemode.Symlink {
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(files, func(a, b *object.File) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	manifests := []Manifest{}
+	for _, p := range rooted {
+		if p == Stdin {
+			read, err := ReadFiles([]string{Stdin}, stdin)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, read...)
+			continue
+		}
+		for _, f := range files {
+			// Files named directly are matched against include and exclude
+			// patterns by their path relative to the working directory, as
+			// ExpandFiles matches them by the argument.
+			local, err := filepath.Rel(wd, filepath.Join(root, filepath.FromSlash(f.Name)))
+			if err != nil {
+				return nil, err
+			}
+			if !selectRevisionFile(f.Name, local, p, include, exclude) {
+				continue
+			}
+			contents, err := f.Contents()
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, Manifest{Name: revision + ":" + f.Name, Contents: []byte(contents)})
+		}
+	}
+	return manifests, nil
+}
+
+// selectRevisionFile reports whether a file of a tree, named relative to the
+// root of the repository and local to the working directory, is selected by a
+// path relative to the root of the repository, either directly or by walking
+// one of its directories, as ExpandFiles would select it in the working tree.
+func selectRevisionFile(name, local, p string, include, exclude []string) bool {
+	parts := strings.Split(name, "/")
+	start := 0
+	if p != "." {
+		start = -1
+		for i := range parts {
+			if matched, _ := path.Match(p, strings.Join(parts[:i+1], "/")); matched {
+				start = i + 1
+				break
+			}
+		}
+		if start == -1 {
+			return false
+		}
+		// Files named directly are read whatever their extension.
+		if start == len(parts) {
+			return selectFile(local, include, exclude)
+		}
+	}
+	for i := start; i < len(parts)-1; i++ {
+		if strings.HasPrefix(parts[i], ".") || matchesAny(strings.Join(parts[start:i+1], "/"), exclude) {
+			return false
+		}
+	}
+	if len(include) == 0 && !slices.Contains(inputExtensions, strings.ToLower(path.Ext(name))) {
+		return false
+	}
+	return selectFile(strings.Join(parts[start:], "/"), include, exclude)
+}
@@ -0,0 +1,91 @@
+package npv
+
+import (
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+)
+
+const (
+	// ChartReleaseName is the release name charts are rendered with, as
+	// helm template does when not given one.
+	ChartReleaseName = "release-name"
+	// ChartNamespace is the namespace charts are rendered in.
+	ChartNamespace = "default"
+)
+
+// clusterScopedKinds are the kinds read by npv that have no namespace.
+var clusterScopedKinds = []string{
+	"Namespace",
+	"GlobalNetworkPolicy",
+	"CiliumClusterwideNetworkPolicy",
+	"AdminNetworkPolicy",
+	"BaselineAdminNetworkPolicy",
+}
+
+// RenderChart renders the templates of the Helm chart in a directory or
+// archive with the given values files, as helm template would. Later values
+// files override earlier ones, which override the values of the chart. No
+// cluster or network is used: lookup returns nothing and the capabilities are
+// Helm's defaults. The manifests are returned as rendered, in memory, named
+// by template path, such as mychart/templates/networkpolicy.yaml, and sorted
+// by it. Only YAML and JSON templates that render to something other than
+// whitespace are returned. Installing the chart would put the objects without
+// a namespace in ChartNamespace, which Objects.SetDefaultNamespace does once
+// they are decoded.
+func RenderChart(dir string, valuesFiles []string) ([]Manifest, error) {
+	chart, err := loader.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	for _, file := range valuesFiles {
+		fileValues, err := chartutil.ReadValuesFile(file)
+		if err != nil {
+			return nil, err
+		}
+		values = chartutil.CoalesceTables(fileValues, values)
+	}
+	if err := chartutil.ProcessDependenciesWithMerge(chart, values); err != nil {
+		return nil, err
+	}
+	options := chartutil.ReleaseOptions{
+		Name:      ChartReleaseName,
+		Namespace: ChartNamespace,
+		Revision:  1,
+		IsInstall: true,
+	}
+	renderValues, err := chartutil.ToRenderValues(chart, values, options, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := engine.Render(chart, renderValues)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []Manifest{}
+	for _, name := range maputils.SortedKeys(rendered) {
+		contents := rendered[name]
+		if !slices.Contains(inputExtensions, strings.ToLower(path.Ext(name))) || strings.TrimSpace(contents) == "" {
+			continue
+		}
+		manifests = append(manifests, Manifest{Name: name, Contents: []byte(contents)})
+	}
+	return manifests, nil
+}
+
+// SetDefaultNamespace puts the namespaced objects that have no namespace in
+// the given namespace, as applying them to it would.
+func (o *Objects) SetDefaultNamespace(namespace string) {
+	for _, obj := range o.objects {
+		if obj.GetNamespace() != "" || slices.Contains(clusterScopedKinds, obj.GetKind()) {
+			continue
+		}
+		obj.SetNamespace(namespace)
+	}
+}
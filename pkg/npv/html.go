@@ -0,0 +1,128 @@
+package npv
+
+import (
+	_ "embed"
+	"html/template"
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+)
+
+//go:embed html.tmpl
+var htmlTemplateText string
+
+var htmlTemplate = template.Must(template.New("html").Parse(htmlTemplateText))
+
+type htmlNode struct {
+	ID      string
+	Class   string
+	Title   string
+	Tooltip string
+}
+
+type htmlEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Port string `json:"port"`
+	Deny bool   `json:"deny"`
+	// Action is the lower case action of rules that do not allow traffic.
+	Action string `json:"action,omitempty"`
+}
+
+type htmlPolicy struct {
+	Name      string
+	Namespace string
+	Pod       string
+}
+
+type htmlReport struct {
+	Pods     []htmlNode
+	Ingress  []htmlNode
+	Egress   []htmlNode
+	Edges    []htmlEdge
+	Policies []htmlPolicy
+}
+
+func generateHTML(
+	pods map[string]pod,
+	categories []string,
+) (string, error) {
+	report := htmlReport{
+		Edges: []htmlEdge{},
+	}
+	ids := idsByTier(maputils.SortedKeys(pods), pods)
+	ingressNodes := map[string]htmlNode{}
+	egressNodes := map[string]htmlNode{}
+	for _, id := range ids {
+		pod := pods[id]
+		podId := "p_" + id
+		included := false
+		if slices.Contains(categories, "ingress") {
+			for _, t := range pod.ingress {
+				peerId := "i_" + t.peerId
+				if _, present := ingressNodes[peerId]; !present {
+					ingressNodes[peerId] = newHTMLTargetNode(peerId, t)
+				}
+				report.Edges = append(report.Edges, newHTMLEdge(peerId, podId, t))
+				included = true
+			}
+		}
+		if slices.Contains(categories, "egress") {
+			for _, t := range pod.egress {
+				peerId := "e_" + t.peerId
+				if _, present := egressNodes[peerId]; !present {
+					egressNodes[peerId] = newHTMLTargetNode(peerId, t)
+				}
+				report.Edges = append(report.Edges, newHTMLEdge(podId, peerId, t))
+				included = true
+			}
+		}
+		if !included {
+			continue
+		}
+		report.Pods = append(report.Pods, htmlNode{
+			ID:      podId,
+			Title:   strings.Join(pod.names, ", ") + " (" + pod.namespace + ")",
+			Tooltip: pod.Label(),
+		})
+		for _, name := range pod.names {
+			report.Policies = append(report.Policies, htmlPolicy{Name: name, Namespace: pod.namespace, Pod: podId})
+		}
+	}
+	for _, peerId := range maputils.SortedKeys(ingressNodes) {
+		report.Ingress = append(report.Ingress, ingressNodes[peerId])
+	}
+	for _, peerId := range maputils.SortedKeys(egressNodes) {
+		report.Egress = append(report.Egress, egressNodes[peerId])
+	}
+	slices.SortFunc(report.Policies, func(l, r htmlPolicy) int {
+		if c := strings.Compare(l.Namespace, r.Namespace); c != 0 {
+			return c
+		}
+		return strings.Compare(l.Name, r.Name)
+	})
+	b := strings.Builder{}
+	if err := htmlTemplate.Execute(&b, report); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func newHTMLTargetNode(id string, t target) htmlNode {
+	label := t.Label()
+	return htmlNode{
+		ID:      id,
+		Class:   t.peerStyle(),
+		Title:   strings.Join(strings.Fields(label), " "),
+		Tooltip: strings.TrimRight(label, "\n") + "\n",
+	}
+}
+
+func newHTMLEdge(from, to string, t target) htmlEdge {
+	e := htmlEdge{From: from, To: to, Port: edgeLabel(t), Deny: t.blockAll}
+	if t.action != "" && t.action != Allow {
+		e.Action = strings.ToLower(string(t.action))
+	}
+	return e
+}
@@ -0,0 +1,381 @@
+package npv
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// AuthorizationPolicyKind is the kind of Istio authorization policies.
+	AuthorizationPolicyKind = "AuthorizationPolicy"
+	// IstioRootNamespace is the namespace of Istio authorization policies
+	// that apply to workloads in every namespace.
+	IstioRootNamespace = "istio-system"
+)
+
+var (
+	// AuthorizationPolicies is the resource of AuthorizationPolicy.
+	AuthorizationPolicies = schema.GroupVersionResource{Group: "security.istio.io", Version: "v1", Resource: "authorizationpolicies"}
+	// authorizationPoliciesV1beta1 is the resource of AuthorizationPolicy
+	// served by Istio releases without the v1 API.
+	authorizationPoliciesV1beta1 = schema.GroupVersionResource{Group: "security.istio.io", Version: "v1beta1", Resource: "authorizationpolicies"}
+)
+
+// Custom delegates the decision to an external authorizer. Only Istio
+// authorization policies have it.
+const Custom Action = "Custom"
+
+// AuthorizationPolicy is a security.istio.io AuthorizationPolicy. Only the
+// fields npv draws are decoded.
+type AuthorizationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              AuthorizationPolicySpec `json:"spec"`
+}
+
+// AuthorizationPolicySpec selects workloads and lists the requests its action
+// applies to. The action is ALLOW when empty. An ALLOW policy without rules
+// matches no request and so denies all requests.
+type AuthorizationPolicySpec struct {
+	Selector *IstioWorkloadSelector `json:"selector,omitempty"`
+	Action   string                 `json:"action,omitempty"`
+	Rules    []IstioRule            `json:"rules,omitempty"`
+}
+
+// IstioWorkloadSelector selects workloads by their labels. No labels selects
+// all workloads of the namespace.
+type IstioWorkloadSelector struct {
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
+
+// IstioRule matches requests from any of its sources to any of its
+// operations when all of its conditions hold.
+type IstioRule struct {
+	From []IstioFrom      `json:"from,omitempty"`
+	To   []IstioTo        `json:"to,omitempty"`
+	When []IstioCondition `json:"when,omitempty"`
+}
+
+// IstioFrom holds a source.
+type IstioFrom struct {
+	Source IstioSource `json:"source"`
+}
+
+// IstioTo holds an operation.
+type IstioTo struct {
+	Operation IstioOperation `json:"operation"`
+}
+
+// IstioSource matches the peer of a request. All of its fields must match.
+type IstioSource struct {
+	Principals           []string `json:"principals,omitempty"`
+	NotPrincipals        []string `json:"notPrincipals,omitempty"`
+	RequestPrincipals    []string `json:"requestPrincipals,omitempty"`
+	NotRequestPrincipals []string `json:"notRequestPrincipals,omitempty"`
+	Namespaces           []string `json:"namespaces,omitempty"`
+	NotNamespaces        []string `json:"notNamespaces,omitempty"`
+	IPBlocks             []string `json:"ipBlocks,omitempty"`
+	NotIPBlocks          []string `json:"notIpBlocks,omitempty"`
+	RemoteIPBlocks       []string `json:"remoteIpBlocks,omitempty"`
+	NotRemoteIPBlocks    []string `json:"notRemoteIpBlocks,omitempty"`
+}
+
+// IstioOperation matches the request itself. All of its fields must match.
+type IstioOperation struct {
+	Hosts      []string `json:"hosts,omitempty"`
+	NotHosts   []string `json:"notHosts,omitempty"`
+	Ports      []string `json:"ports,omitempty"`
+	NotPorts   []string `json:"notPorts,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	NotMethods []string `json:"notMethods,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+	NotPaths   []string `json:"notPaths,omitempty"`
+}
+
+// IstioCondition matches an attribute of the request.
+type IstioCondition struct {
+	Key       string   `json:"key"`
+	Values    []string `json:"values,omitempty"`
+	NotValues []string `json:"notValues,omitempty"`
+}
+
+// fields returns the name and values of the fields of the source that are
+// set, in a fixed order.
+func (s IstioSource) fields() [][2]string {
+	return istioFields([]istioField{
+		{"principals", s.Principals},
+		{"not principals", s.NotPrincipals},
+		{"request principals", s.RequestPrincipals},
+		{"not request principals", s.NotRequestPrincipals},
+		{"namespaces", s.Namespaces},
+		{"not namespaces", s.NotNamespaces},
+		{"ip blocks", s.IPBlocks},
+		{"not ip blocks", s.NotIPBlocks},
+		{"remote ip blocks", s.RemoteIPBlocks},
+		{"not remote ip blocks", s.NotRemoteIPBlocks},
+	})
+}
+
+// Label describes the source.
+func (s IstioSource) Label() string {
+	fields := s.fields()
+	if len(fields) == 0 {
+		return "Mesh Source:\n    All"
+	}
+	lines := []string{"Mesh Source:"}
+	for _, field := range fields {
+		lines = append(lines, "    "+field[0]+": "+field[1])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Summary describes the source on one line.
+func (s IstioSource) Summary() string {
+	fields := s.fields()
+	if len(fields) == 0 {
+		return "all"
+	}
+	parts := []string{}
+	for _, field := range fields {
+		parts = append(parts, field[0]+" "+field[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+type istioField struct {
+	name   string
+	values []string
+}
+
+func istioFields(fields []istioField) [][2]string {
+	result := [][2]string{}
+	for _, field := range fields {
+		if len(field.values) > 0 {
+			result = append(result, [2]string{field.name, strings.Join(field.values, ", ")})
+		}
+	}
+	return result
+}
+
+// LoadIstioNamespaces returns the AuthorizationPolicies in the given
+// namespaces, or in all namespaces when none are given. The policies of the
+// Istio root namespace are always returned as they apply to every namespace.
+// No policies are returned when Istio is not installed.
+func LoadIstioNamespaces(ctx context.Context, client dynamic.Interface, namespaces []string) ([]AuthorizationPolicy, error) {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	} else if !slices.Contains(namespaces, IstioRootNamespace) {
+		namespaces = append(slices.Clone(namespaces), IstioRootNamespace)
+	}
+	items, err := loadIstio(ctx, client, AuthorizationPolicies, namespaces)
+	if apierrors.IsNotFound(err) {
+		items, err = loadIstio(ctx, client, authorizationPoliciesV1beta1, namespaces)
+	}
+	if apierrors.IsNotFound(err) {
+		return []AuthorizationPolicy{}, nil
+	}
+	return items, err
+}
+
+func loadIstio(ctx context.Context, client dynamic.Interface, resource schema.GroupVersionResource, namespaces []string) ([]AuthorizationPolicy, error) {
+	items := []AuthorizationPolicy{}
+	for _, namespace := range namespaces {
+		list, err := client.Resource(resource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			var policy AuthorizationPolicy
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &policy); err != nil {
+				return nil, err
+			}
+			items = append(items, policy)
+		}
+	}
+	return items, nil
+}
+
+// LoadIstioFiles returns the AuthorizationPolicies in the given files. Each
+// file may be a glob and may contain multiple YAML or JSON documents. Other
+// kinds are ignored and documents that cannot be decoded are returned as
+// DecodeErrors, as with LoadFiles.
+func LoadIstioFiles(files []string) ([]AuthorizationPolicy, error) {
+	return loadFiles(files, (*Objects).IstioPolicies)
+}
+
+// IstioPolicies returns the AuthorizationPolicies among the objects. Objects
+// that cannot be converted are returned as DecodeErrors along with the others.
+func (o *Objects) IstioPolicies() ([]AuthorizationPolicy, error) {
+	items := []AuthorizationPolicy{}
+	err := o.each(func(obj *unstructured.Unstructured) error {
+		gvk := obj.GroupVersionKind()
+		if gvk.Group != AuthorizationPolicies.Group || gvk.Kind != AuthorizationPolicyKind {
+			return nil
+		}
+		var policy AuthorizationPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+			return err
+		}
+		items = append(items, policy)
+		return nil
+	})
+	return items, err
+}
+
+// AddIstioPolicies overlays Istio authorization policies on the model. The
+// workloads a policy selects share the pod group of network policies with the
+// same selector, and every rule becomes an ingress target from a mesh source
+// with the action of the policy and the operations and conditions of the rule
+// as its request. Policies in the Istio root namespace select workloads in
+// every namespace.
+func (m *Model) AddIstioPolicies(policies []AuthorizationPolicy) {
+	for _, policy := range policies {
+		selector := metav1.LabelSelector{}
+		if policy.Spec.Selector != nil && len(policy.Spec.Selector.MatchLabels) > 0 {
+			selector.MatchLabels = policy.Spec.Selector.MatchLabels
+		}
+		clusterWide := policy.Namespace == IstioRootNamespace
+		key := podKey(policy.Namespace, selector)
+		if clusterWide {
+			key = "_CLUSTER_" + podKey("", selector)
+		}
+		p, present := m.pods[key]
+		if !present {
+			p = pod{
+				id:          key,
+				namespace:   policy.Namespace,
+				selector:    selector,
+				clusterWide: clusterWide,
+			}
+		}
+		name := policy.Kind + "/" + policy.Name
+		if !slices.Contains(p.names, name) {
+			p.names = append(p.names, name)
+		}
+		action := istioAction(policy.Spec.Action)
+		p.ingress = append(p.ingress, istioTargets(policy.Spec.Rules, action)...)
+		// An ALLOW policy without rules matches no request, so requests that
+		// no other ALLOW policy matches are denied.
+		if len(policy.Spec.Rules) == 0 && action == Allow {
+			p.ingress = append(p.ingress, target{id: p.id + "_ALL_", peerId: "_ALL_PEER_INGRESS_", blockAll: true})
+		}
+		m.pods[key] = p
+	}
+	m.pods = sorted(m.pods)
+}
+
+// istioAction converts the action of an authorization policy. AUDIT only logs
+// requests.
+func istioAction(action string) Action {
+	switch action {
+	case "DENY":
+		return Deny
+	case "AUDIT":
+		return Log
+	case "CUSTOM":
+		return Custom
+	default:
+		return Allow
+	}
+}
+
+// istioTargets converts the rules of an authorization policy into one target
+// per source, operation and port.
+func istioTargets(rules []IstioRule, action Action) []target {
+	targets := []target{}
+	for i, rule := range rules {
+		templates := []target{}
+		for _, from := range rule.From {
+			source := from.Source
+			templates = append(templates, target{
+				peerId: "_MESH_" + normalizePlantUMLId(strings.ReplaceAll(source.Summary(), " ", "_")),
+				mesh:   &source,
+			})
+		}
+		if len(templates) == 0 {
+			templates = append(templates, target{peerId: "_ALL_PEER_INGRESS", allPeers: true, allowAll: action == Allow})
+		}
+		operations := []IstioOperation{}
+		for _, to := range rule.To {
+			operations = append(operations, to.Operation)
+		}
+		if len(operations) == 0 {
+			operations = append(operations, IstioOperation{})
+		}
+		precedence := fmt.Sprintf("rule %d", i)
+		for _, template := range templates {
+			for _, operation := range operations {
+				request := istioRequest(operation, rule.When)
+				// Targets of a rule differ by their request as well.
+				key := strings.TrimSpace(precedence + " " + request)
+				for _, port := range istioPorts(operation.Ports) {
+					t := template
+					t.port = port
+					t.action = action
+					t.precedence = precedence
+					t.request = request
+					t.id = orderedTargetKey(t.peerId, port, key, action)
+					targets = append(targets, t)
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// istioRequest describes the operation and conditions of a rule other than
+// its ports, such as "GET /api/*".
+func istioRequest(operation IstioOperation, when []IstioCondition) string {
+	parts := []string{}
+	if len(operation.Methods) > 0 {
+		parts = append(parts, strings.Join(operation.Methods, ","))
+	}
+	if len(operation.Paths) > 0 {
+		parts = append(parts, strings.Join(operation.Paths, ","))
+	}
+	for _, field := range istioFields([]istioField{
+		{"hosts", operation.Hosts},
+		{"not hosts", operation.NotHosts},
+		{"not ports", operation.NotPorts},
+		{"not methods", operation.NotMethods},
+		{"not paths", operation.NotPaths},
+	}) {
+		parts = append(parts, field[0]+" "+field[1])
+	}
+	for _, condition := range when {
+		if len(condition.Values) > 0 {
+			parts = append(parts, "when "+condition.Key+" in "+strings.Join(condition.Values, ","))
+		}
+		if len(condition.NotValues) > 0 {
+			parts = append(parts, "when "+condition.Key+" not in "+strings.Join(condition.NotValues, ","))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// istioPorts converts the ports of an operation. Istio only authorizes TCP
+// traffic. No ports means all ports.
+func istioPorts(ports []string) []networkingv1.NetworkPolicyPort {
+	if len(ports) == 0 {
+		return []networkingv1.NetworkPolicyPort{{}}
+	}
+	result := []networkingv1.NetworkPolicyPort{}
+	for _, port := range ports {
+		protocol := corev1.ProtocolTCP
+		p := intstr.Parse(port)
+		result = append(result, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &p})
+	}
+	return result
+}
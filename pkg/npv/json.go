@@ -0,0 +1,176 @@
+package npv
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/mrxk/npv/internal/maputils"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SchemaVersion identifies the layout of Document. It changes whenever a
+// field is removed or the meaning of an existing field changes. Adding fields
+// does not change the version.
+const SchemaVersion = "npv/v2"
+
+// Document is the JSON representation of the model npv builds from a set of
+// network policies. Every diagram npv draws is a rendering of this model.
+type Document struct {
+	// Version is always SchemaVersion.
+	Version string `json:"version"`
+	// Pods holds one entry per distinct namespace and pod selector, sorted by
+	// ID.
+	Pods []Pod `json:"pods"`
+}
+
+// Pod is a group of pods selected by one or more network policies with
+// identical pod selectors in the same namespace.
+type Pod struct {
+	// ID uniquely identifies the pod group within the document.
+	ID string `json:"id"`
+	// Policies holds the sorted names of the policies that select the pods.
+	Policies []string `json:"policies"`
+	// Namespace is the namespace of the policies. It is empty for cluster
+	// wide policies.
+	Namespace string `json:"namespace"`
+	// ClusterWide is set when the policies select pods in every namespace.
+	ClusterWide bool `json:"clusterWide,omitempty"`
+	// NamespaceSelector is set when cluster wide policies only select pods
+	// in the namespaces it matches.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Tier is AdminNetworkPolicy or BaselineAdminNetworkPolicy for the pod
+	// groups of admin network policies, which are evaluated before and after
+	// other policies. It is empty for other policies.
+	Tier string `json:"tier,omitempty"`
+	// InferredPolicyTypes describes the policy types assumed for the
+	// policies that do not declare any, as "name: Ingress, Egress", sorted.
+	InferredPolicyTypes []string `json:"inferredPolicyTypes,omitempty"`
+	// Selector is the pod selector shared by the policies.
+	Selector metav1.LabelSelector `json:"selector"`
+	// Ingress holds the peers the pods accept traffic from.
+	Ingress []Target `json:"ingress"`
+	// Egress holds the peers the pods may send traffic to.
+	Egress []Target `json:"egress"`
+	// Selected holds the pods the selector matches. It is only set when the
+	// model has been resolved against the workloads in a cluster.
+	Selected *Selection `json:"selected,omitempty"`
+}
+
+// Target is a peer and port that a pod group may exchange traffic with.
+type Target struct {
+	// ID identifies the peer and port combination.
+	ID string `json:"id"`
+	// PeerID identifies the peer. Targets sharing a peer share a PeerID.
+	PeerID string `json:"peerId"`
+	// Peer is the peer as written in the network policy. It is empty when
+	// AllPeers or DenyAll is set.
+	Peer networkingv1.NetworkPolicyPeer `json:"peer"`
+	// Port is the port as written in the network policy. It is empty when
+	// the rule applies to all ports.
+	Port networkingv1.NetworkPolicyPort `json:"port"`
+	// AllowAll is set when the rule allows traffic with every peer on Port.
+	AllowAll bool `json:"allowAll"`
+	// AllPeers is set when the rule applies to traffic with every peer on
+	// Port, whatever its Action. Rules that allow the traffic also set
+	// AllowAll, while those that deny, log or pass it only set AllPeers.
+	AllPeers bool `json:"allPeers,omitempty"`
+	// DenyAll is set when a policy type is declared without any rules,
+	// denying all traffic in that direction.
+	DenyAll bool `json:"denyAll"`
+	// Entity is set when the peer is a Cilium entity such as world. Peer is
+	// empty.
+	Entity string `json:"entity,omitempty"`
+	// FQDN is set when the peer is a DNS name or pattern. Peer is empty.
+	FQDN string `json:"fqdn,omitempty"`
+	// Nodes is set when the peer is the nodes matching a selector. Peer is
+	// empty.
+	Nodes *metav1.LabelSelector `json:"nodes,omitempty"`
+	// Action is set when the rule has an explicit action, such as the Deny
+	// rules of Calico policies. Other rules allow the traffic.
+	Action Action `json:"action,omitempty"`
+	// Precedence is set when the rule is ordered and describes when it is
+	// evaluated, such as "order 100 rule 2".
+	Precedence string `json:"precedence,omitempty"`
+	// Mesh is set when the peer is the source of an Istio authorization
+	// policy rule. Peer is empty.
+	Mesh *IstioSource `json:"mesh,omitempty"`
+	// Request is set when the rule only matches some requests and describes
+	// them, such as "GET /api/*".
+	Request string `json:"request,omitempty"`
+	// Except is set when the rule excludes some of the traffic Peer and Port
+	// match and describes it, such as "nets 10.0.0.0/8" for the notNets of
+	// Calico rules.
+	Except []string `json:"except,omitempty"`
+	// Selected holds the namespaces and pods the peer matches. It is only
+	// set when the model has been resolved against the workloads in a
+	// cluster and the peer is not an IPBlock.
+	Selected *Selection `json:"selected,omitempty"`
+}
+
+func generateJSON(pods map[string]pod, categories []string) (string, error) {
+	content, err := json.MarshalIndent(newDocument(pods, categories), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content) + "\n", nil
+}
+
+func newDocument(pods map[string]pod, categories []string) Document {
+	d := Document{
+		Version: SchemaVersion,
+		Pods:    []Pod{},
+	}
+	for _, id := range maputils.SortedKeys(pods) {
+		pod := pods[id]
+		p := Pod{
+			ID:                  pod.id,
+			Policies:            pod.names,
+			Namespace:           pod.namespace,
+			ClusterWide:         pod.clusterWide,
+			NamespaceSelector:   pod.namespaceSelector,
+			Tier:                pod.tier,
+			InferredPolicyTypes: pod.inferred,
+			Selector:            pod.selector,
+			Ingress:             []Target{},
+			Egress:              []Target{},
+			Selected:            pod.selection,
+		}
+		if slices.Contains(categories, "ingress") {
+			p.Ingress = newTargets(pod.ingress)
+		}
+		if slices.Contains(categories, "egress") {
+			p.Egress = newTargets(pod.egress)
+		}
+		if len(p.Ingress) == 0 && len(p.Egress) == 0 {
+			continue
+		}
+		d.Pods = append(d.Pods, p)
+	}
+	return d
+}
+
+func newTargets(targets []target) []Target {
+	result := []Target{}
+	for _, t := range targets {
+		result = append(result, Target{
+			ID:         t.id,
+			PeerID:     t.peerId,
+			Peer:       t.peer,
+			Port:       t.port,
+			AllowAll:   t.allowAll,
+			AllPeers:   t.allPeers,
+			DenyAll:    t.blockAll,
+			Entity:     t.entity,
+			FQDN:       t.fqdn,
+			Nodes:      t.nodes,
+			Action:     t.action,
+			Precedence: t.precedence,
+			Mesh:       t.mesh,
+			Request:    t.request,
+			Except:     t.except,
+			Selected:   t.selection,
+		})
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package npv
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+)
+
+// IsKustomization reports whether a directory holds a kustomization file.
+func IsKustomization(dir string) bool {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// KustomizationPaths returns the directory of a kustomization along with the
+// local directories its resources, bases and components refer to, followed
+// recursively through the kustomizations they hold, such as a ../../base an
+// overlay builds on. Files they refer to outside of their directory are
+// returned too, while remote resources are skipped.
+func KustomizationPaths(dir string) ([]string, error) {
+	paths := []string{}
+	if err := addKustomizationPaths(filepath.Clean(dir), &paths); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func addKustomizationPaths(dir string, paths *[]string) error {
+	if slices.Contains(*paths, dir) {
+		return nil
+	}
+	*paths = append(*paths, dir)
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		contents, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var kustomization types.Kustomization
+		if err := yaml.Unmarshal(contents, &kustomization); err != nil {
+			return err
+		}
+		references := append(append(kustomization.Resources, kustomization.Bases...), kustomization.Components...)
+		for _, reference := range references {
+			p := filepath.Join(dir, reference)
+			info, err := os.Stat(p)
+			if err != nil {
+				// Remote resources, such as git URLs, are not on disk.
+				continue
+			}
+			if info.IsDir() {
+				if err := addKustomizationPaths(p, paths); err != nil {
+					return err
+				}
+			} else if strings.HasPrefix(reference, "..") && !slices.Contains(*paths, p) {
+				*paths = append(*paths, p)
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// BuildKustomization builds the kustomization in a directory, as kustomize
+// build would, and returns the YAML documents it produces as a manifest named
+// by the directory. Transformers such as namespace and commonLabels, and
+// patches, are applied. Plugins and Helm charts are not run.
+func BuildKustomization(dir string) (Manifest, error) {
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resources, err := kustomizer.Run(filesys.MakeFsOnDisk(), dir)
+	if err != nil {
+		return Manifest{}, err
+	}
+	contents, err := resources.AsYaml()
+	if err != nil {
+		return Manifest{}, err
+	}
+	return Manifest{Name: dir, Contents: contents}, nil
+}
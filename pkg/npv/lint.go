@@ -0,0 +1,176 @@
+package npv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Severity classifies a Finding.
+type Severity string
+
+const (
+	// Error is used for mistakes the API server would reject or that make a
+	// rule behave differently than written.
+	Error Severity = "error"
+	// Warning is used for valid policies that are likely mistakes or that
+	// cannot be fully visualized.
+	Warning Severity = "warning"
+)
+
+// Finding is a problem found in a network policy by Lint.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	// Policy is the namespace/name of the policy.
+	Policy string `json:"policy"`
+	// Field is the path of the offending field, such as
+	// spec.ingress[0].from[1].ipBlock.
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s: %s", f.Severity, f.Policy, f.Field, f.Message)
+}
+
+// Lint checks the given policies for common mistakes. Findings are sorted by
+// policy.
+func Lint(policies []networkingv1.NetworkPolicy) []Finding {
+	findings := []Finding{}
+	for _, policy := range policies {
+		findings = append(findings, lintPolicy(policy)...)
+	}
+	findings = append(findings, lintDuplicates(policies)...)
+	slices.SortStableFunc(findings, func(l, r Finding) int {
+		return strings.Compare(l.Policy, r.Policy)
+	})
+	return findings
+}
+
+// reporter records a finding.
+type reporter func(severity Severity, field, format string, a ...any)
+
+func lintPolicy(policy networkingv1.NetworkPolicy) []Finding {
+	name := policy.Namespace + "/" + policy.Name
+	findings := []Finding{}
+	report := func(severity Severity, field, format string, a ...any) {
+		findings = append(findings, Finding{Severity: severity, Policy: name, Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+	if len(policy.Spec.PolicyTypes) == 0 {
+		types := []string{}
+		for _, t := range effectivePolicyTypes(policy) {
+			types = append(types, string(t))
+		}
+		report(Warning, "spec.policyTypes", "not set, defaults to %s", strings.Join(types, " and "))
+	}
+	lintSelector(policy.Spec.PodSelector, "spec.podSelector", report)
+	for i, rule := range policy.Spec.Ingress {
+		field := fmt.Sprintf("spec.ingress[%d]", i)
+		for j, peer := range rule.From {
+			lintPeer(peer, fmt.Sprintf("%s.from[%d]", field, j), report)
+		}
+		for j, port := range rule.Ports {
+			if port.Port != nil && port.Port.Type == intstr.String {
+				report(Warning, fmt.Sprintf("%s.ports[%d].port", field, j), "named port %s is resolved per pod and its number is unknown", port.Port.StrVal)
+			}
+		}
+	}
+	for i, rule := range policy.Spec.Egress {
+		field := fmt.Sprintf("spec.egress[%d]", i)
+		for j, peer := range rule.To {
+			lintPeer(peer, fmt.Sprintf("%s.to[%d]", field, j), report)
+		}
+	}
+	return findings
+}
+
+func lintPeer(peer networkingv1.NetworkPolicyPeer, field string, report reporter) {
+	if peer.PodSelector != nil {
+		lintSelector(*peer.PodSelector, field+".podSelector", report)
+	}
+	if peer.NamespaceSelector != nil {
+		lintSelector(*peer.NamespaceSelector, field+".namespaceSelector", report)
+	}
+	if peer.IPBlock == nil {
+		return
+	}
+	_, cidr, err := net.ParseCIDR(peer.IPBlock.CIDR)
+	if err != nil {
+		report(Error, field+".ipBlock.cidr", "invalid CIDR %s", peer.IPBlock.CIDR)
+		return
+	}
+	cidrOnes, _ := cidr.Mask.Size()
+	for i, except := range peer.IPBlock.Except {
+		exceptField := fmt.Sprintf("%s.ipBlock.except[%d]", field, i)
+		exceptIP, exceptCIDR, err := net.ParseCIDR(except)
+		if err != nil {
+			report(Error, exceptField, "invalid CIDR %s", except)
+			continue
+		}
+		exceptOnes, _ := exceptCIDR.Mask.Size()
+		if !cidr.Contains(exceptIP) || exceptOnes < cidrOnes {
+			report(Error, exceptField, "%s is not within %s", except, peer.IPBlock.CIDR)
+		}
+	}
+}
+
+// lintSelector checks the operators and values of the match expressions of a
+// selector.
+func lintSelector(s metav1.LabelSelector, field string, report reporter) {
+	for i, expression := range s.MatchExpressions {
+		expressionField := fmt.Sprintf("%s.matchExpressions[%d]", field, i)
+		switch expression.Operator {
+		case metav1.LabelSelectorOpIn, metav1.LabelSelectorOpNotIn:
+			if len(expression.Values) == 0 {
+				report(Error, expressionField+".values", "operator %s on %s requires values", expression.Operator, expression.Key)
+			}
+		case metav1.LabelSelectorOpExists, metav1.LabelSelectorOpDoesNotExist:
+			if len(expression.Values) > 0 {
+				report(Error, expressionField+".values", "operator %s on %s must not have values", expression.Operator, expression.Key)
+			}
+		default:
+			report(Error, expressionField+".operator", "invalid operator %q", expression.Operator)
+		}
+	}
+}
+
+// lintDuplicates reports rules that are identical to a rule of another policy,
+// or of the same policy, selecting the same pods. The first rule in order of
+// policy namespace and name is not reported.
+func lintDuplicates(policies []networkingv1.NetworkPolicy) []Finding {
+	findings := []Finding{}
+	policies = slices.Clone(policies)
+	slices.SortStableFunc(policies, func(l, r networkingv1.NetworkPolicy) int {
+		return strings.Compare(l.Namespace+"/"+l.Name, r.Namespace+"/"+r.Name)
+	})
+	seen := map[string]string{}
+	check := func(policy networkingv1.NetworkPolicy, direction string, i int, rule any) {
+		name := policy.Namespace + "/" + policy.Name
+		field := fmt.Sprintf("spec.%s[%d]", direction, i)
+		content, err := json.Marshal(rule)
+		if err != nil {
+			return
+		}
+		key := podKey(policy.Namespace, policy.Spec.PodSelector) + "/" + direction + "/" + string(content)
+		if first, present := seen[key]; present {
+			findings = append(findings, Finding{Severity: Warning, Policy: name, Field: field, Message: "duplicates " + first})
+			return
+		}
+		seen[key] = name + " " + field
+	}
+	for _, policy := range policies {
+		for i, rule := range policy.Spec.Ingress {
+			check(policy, "ingress", i, rule)
+		}
+		for i, rule := range policy.Spec.Egress {
+			check(policy, "egress", i, rule)
+		}
+	}
+	return findings
+}
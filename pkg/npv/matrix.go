@@ -0,0 +1,197 @@
+package npv
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mrxk/npv/internal/maputils"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Matrix is a table of pod groups versus the peers they exchange traffic with.
+// Each cell holds the ports allowed between the pod group of the row and the
+// peer of the column.
+type Matrix struct {
+	// Rows holds one description per pod group.
+	Rows []string
+	// Columns holds one description per peer, prefixed with "from " for
+	// ingress peers and "to " for egress peers.
+	Columns []string
+	// Cells is indexed by row and then column. Cells are empty when the pod
+	// group has no rule for the peer and "deny" when a policy denies all
+	// traffic in that direction.
+	Cells [][]string
+}
+
+// NewMatrix builds the connectivity matrix of the model.
+func NewMatrix(model *Model, options RenderOptions) *Matrix {
+	categories := options.categories()
+	cells := map[string]map[string][]string{}
+	rows := []string{}
+	columns := map[string]struct{}{}
+	add := func(row, column, value string) {
+		if _, present := cells[row]; !present {
+			cells[row] = map[string][]string{}
+			rows = append(rows, row)
+		}
+		if !slices.Contains(cells[row][column], value) {
+			cells[row][column] = append(cells[row][column], value)
+		}
+		columns[column] = struct{}{}
+	}
+	for _, id := range maputils.SortedKeys(model.pods) {
+		pod := model.pods[id]
+		row := pod.namespace + ": " + selectorSummary(pod.selector)
+		if slices.Contains(categories, "ingress") {
+			for _, t := range pod.ingress {
+				add(row, "from "+targetSummary(t), matrixCell(t))
+			}
+		}
+		if slices.Contains(categories, "egress") {
+			for _, t := range pod.egress {
+				add(row, "to "+targetSummary(t), matrixCell(t))
+			}
+		}
+	}
+	m := &Matrix{
+		Rows:    rows,
+		Columns: maputils.SortedKeys(columns),
+	}
+	for _, row := range m.Rows {
+		values := []string{}
+		for _, column := range m.Columns {
+			values = append(values, strings.Join(cells[row][column], ", "))
+		}
+		m.Cells = append(m.Cells, values)
+	}
+	return m
+}
+
+// Render formats the matrix as a text table, CSV or Markdown. An empty format
+// selects a text table.
+func (m *Matrix) Render(format string) (string, error) {
+	switch format {
+	case "", "text":
+		return m.text(), nil
+	case "csv":
+		return m.csv()
+	case "markdown":
+		return m.markdown(), nil
+	default:
+		return "", fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+func (m *Matrix) text() string {
+	b := bytes.Buffer{}
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\t"+strings.Join(m.Columns, "\t"))
+	for i, row := range m.Rows {
+		values := []string{}
+		for _, value := range m.Cells[i] {
+			if value == "" {
+				value = "-"
+			}
+			values = append(values, value)
+		}
+		fmt.Fprintln(w, row+"\t"+strings.Join(values, "\t"))
+	}
+	w.Flush()
+	return b.String()
+}
+
+func (m *Matrix) csv() (string, error) {
+	b := bytes.Buffer{}
+	w := csv.NewWriter(&b)
+	records := [][]string{append([]string{"pod"}, m.Columns...)}
+	for i, row := range m.Rows {
+		records = append(records, append([]string{row}, m.Cells[i]...))
+	}
+	if err := w.WriteAll(records); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (m *Matrix) markdown() string {
+	b := strings.Builder{}
+	escape := strings.NewReplacer("|", "\\|").Replace
+	header := []string{"Pod"}
+	for _, column := range m.Columns {
+		header = append(header, escape(column))
+	}
+	b.WriteString("| " + strings.Join(header, " | ") + " |\n")
+	b.WriteString(strings.Repeat("| --- ", len(header)) + "|\n")
+	for i, row := range m.Rows {
+		values := []string{escape(row)}
+		for _, value := range m.Cells[i] {
+			values = append(values, escape(value))
+		}
+		b.WriteString("| " + strings.Join(values, " | ") + " |\n")
+	}
+	return b.String()
+}
+
+func matrixCell(t target) string {
+	if t.blockAll {
+		return "deny"
+	}
+	return edgeLabel(t)
+}
+
+// selectorSummary returns a single line description of a label selector.
+func selectorSummary(s metav1.LabelSelector) string {
+	if len(s.MatchLabels) == 0 && len(s.MatchExpressions) == 0 {
+		return "all"
+	}
+	if expression, ok := calicoExpression(s); ok {
+		return expression
+	}
+	return metav1.FormatLabelSelector(&s)
+}
+
+// peerSummary returns a single line description of a peer.
+func peerSummary(p networkingv1.NetworkPolicyPeer) string {
+	parts := []string{}
+	if p.NamespaceSelector != nil {
+		parts = append(parts, "namespace "+selectorSummary(*p.NamespaceSelector))
+	}
+	if p.PodSelector != nil {
+		parts = append(parts, "pod "+selectorSummary(*p.PodSelector))
+	}
+	if p.IPBlock != nil {
+		ipblock := "ipBlock " + p.IPBlock.CIDR
+		if len(p.IPBlock.Except) > 0 {
+			ipblock += " except " + strings.Join(p.IPBlock.Except, ",")
+		}
+		parts = append(parts, ipblock)
+	}
+	return strings.Join(parts, " ")
+}
+
+// targetSummary returns a single line description of the peer of a target.
+func targetSummary(t target) string {
+	if len(t.except) > 0 {
+		u := t
+		u.except = nil
+		return targetSummary(u) + " except " + strings.Join(t.except, ", ")
+	}
+	switch {
+	case t.blockAll || t.allPeers:
+		return "all"
+	case t.entity != "":
+		return "entity " + t.entity
+	case t.fqdn != "":
+		return "fqdn " + t.fqdn
+	case t.nodes != nil:
+		return "nodes " + selectorSummary(*t.nodes)
+	case t.mesh != nil:
+		return "mesh " + t.mesh.Summary()
+	}
+	return peerSummary(t.peer)
+}
@@ -0,0 +1,198 @@
+package npv
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+)
+
+var mermaidIdReplacer = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// mermaidLinkStyles lists the link styles of edges in the order they are
+// applied.
+var mermaidLinkStyles = []string{
+	"stroke:green",
+	"stroke:red,stroke-dasharray:5",
+	"stroke:red",
+	"stroke:orange",
+	"stroke:gray",
+	"stroke:purple",
+}
+
+// mermaidEdges accumulates edges so that link styles can be applied by index
+// once all edges have been written.
+type mermaidEdges struct {
+	b      strings.Builder
+	count  int
+	styles map[string][]string
+}
+
+func (e *mermaidEdges) add(from, to string, t target) {
+	arrow := "-->"
+	style := "stroke:" + edgeColor(t)
+	if t.blockAll {
+		arrow = "-.->"
+		style += ",stroke-dasharray:5"
+	}
+	if e.styles == nil {
+		e.styles = map[string][]string{}
+	}
+	e.styles[style] = append(e.styles[style], strconv.Itoa(e.count))
+	e.b.WriteString(fmt.Sprintf("    %s %s|\"%s\"| %s\n", idMermaid(from), arrow, strings.ReplaceAll(edgeLabel(t), "\"", "#quot;"), idMermaid(to)))
+	e.count++
+}
+
+func (e *mermaidEdges) String() string {
+	b := strings.Builder{}
+	b.WriteString(e.b.String())
+	for _, style := range mermaidLinkStyles {
+		if indexes := e.styles[style]; len(indexes) > 0 {
+			b.WriteString(fmt.Sprintf("    linkStyle %s %s\n", strings.Join(indexes, ","), style))
+		}
+	}
+	return b.String()
+}
+
+func generatePodMermaid(ids []string, pods map[string]pod, categories []string) string {
+	b := strings.Builder{}
+	for _, tier := range podTiers {
+		tierIds := tierPods(ids, pods, tier.tier, categories)
+		if tier.tier != "" && len(tierIds) == 0 {
+			continue
+		}
+		b.WriteString("    subgraph " + tier.title + "\n")
+		for _, id := range tierIds {
+			pod := pods[id]
+			b.WriteString(fmt.Sprintf("        %s[\"%s\"]\n", idMermaid(id), labelMermaid(pod.Label())))
+		}
+		b.WriteString("    end\n")
+	}
+	return b.String()
+}
+
+func generateIngressMermaid(ids []string, pods map[string]pod, edges *mermaidEdges) string {
+	b := strings.Builder{}
+	ingressNodes := map[string]struct{}{}
+	b.WriteString("    subgraph Ingress\n")
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.ingress {
+			_, present := ingressNodes[t.peerId]
+			if !present {
+				b.WriteString(fmt.Sprintf("        %s[\"%s\"]%s\n", idMermaid(t.peerId+"_i"), labelMermaid(t.Label()), classMermaid(t)))
+				ingressNodes[t.peerId] = struct{}{}
+			}
+		}
+	}
+	b.WriteString("    end\n")
+	// Create edges to connect ingress to pods.
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.ingress {
+			edges.add(t.peerId+"_i", id, t)
+		}
+	}
+	return b.String()
+}
+
+func generateEgressMermaid(ids []string, pods map[string]pod, edges *mermaidEdges) string {
+	b := strings.Builder{}
+	egressNodes := map[string]string{}
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.egress {
+			if _, present := egressNodes[t.peerId]; !present {
+				egressNodes[t.peerId] = fmt.Sprintf("        %s[\"%s\"]%s\n", idMermaid(t.peerId+"_e"), labelMermaid(t.Label()), classMermaid(t))
+			}
+		}
+	}
+	b.WriteString("    subgraph Egress\n")
+	for _, peerId := range maputils.SortedKeys(egressNodes) {
+		b.WriteString(egressNodes[peerId])
+	}
+	b.WriteString("    end\n")
+	// Create edges to connect pods to egress.
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.egress {
+			edges.add(id, t.peerId+"_e", t)
+		}
+	}
+	return b.String()
+}
+
+func generateMermaid(
+	pods map[string]pod,
+	categories []string,
+) string {
+	b := strings.Builder{}
+	b.WriteString("flowchart LR\n")
+	ids := maputils.SortedKeys(pods)
+	edges := &mermaidEdges{}
+	// Create the nodes that represent the pods.
+	b.WriteString(generatePodMermaid(ids, pods, categories))
+	// Create nodes to represent all the ingress peers
+	if slices.Contains(categories, "ingress") {
+		b.WriteString(generateIngressMermaid(ids, pods, edges))
+	}
+	// Create nodes to represent all the egress peers
+	if slices.Contains(categories, "egress") {
+		b.WriteString(generateEgressMermaid(ids, pods, edges))
+	}
+	b.WriteString(edges.String())
+	b.WriteString(classDefsMermaid(ids, pods))
+	return b.String()
+}
+
+// classMermaid returns the class of the node of a peer that is drawn in a
+// style of its own.
+func classMermaid(t target) string {
+	if style := t.peerStyle(); style != "" {
+		return ":::" + style
+	}
+	return ""
+}
+
+// classDefsMermaid defines the classes used by the nodes of the peers.
+func classDefsMermaid(ids []string, pods map[string]pod) string {
+	styles := map[string]struct{}{}
+	for _, id := range ids {
+		for _, t := range append(slices.Clone(pods[id].ingress), pods[id].egress...) {
+			if style := t.peerStyle(); style != "" {
+				styles[style] = struct{}{}
+			}
+		}
+	}
+	b := strings.Builder{}
+	if _, present := styles["entity"]; present {
+		b.WriteString("    classDef entity fill:#add8e6\n")
+	}
+	if _, present := styles["fqdn"]; present {
+		b.WriteString("    classDef fqdn fill:#f0e68c\n")
+	}
+	if _, present := styles["mesh"]; present {
+		b.WriteString("    classDef mesh fill:#e6e6fa\n")
+	}
+	return b.String()
+}
+
+// idMermaid converts an id into one that Mermaid accepts as a node id.
+func idMermaid(id string) string {
+	return mermaidIdReplacer.ReplaceAllString(id, "_")
+}
+
+// labelMermaid converts a multi-line label into a Mermaid node label. Leading
+// indentation is preserved with non-breaking spaces.
+func labelMermaid(label string) string {
+	lines := strings.Split(strings.TrimRight(label, "\n"), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := strings.Repeat("#nbsp;", len(line)-len(trimmed))
+		lines[i] = indent + strings.ReplaceAll(trimmed, "\"", "#quot;")
+	}
+	return strings.Join(lines, "<br/>")
+}
@@ -0,0 +1,642 @@
+package npv
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Model is the set of pod groups, and the peers they exchange traffic with,
+// described by a set of network policies. Renderers turn a Model into a
+// diagram or other representation.
+type Model struct {
+	pods map[string]pod
+}
+
+// NewModel builds the model described by the given network policies.
+func NewModel(policies []networkingv1.NetworkPolicy) (*Model, error) {
+	pods, err := convertToPodRules(policies)
+	if err != nil {
+		return nil, err
+	}
+	return &Model{pods: pods}, nil
+}
+
+// Document returns the JSON representation of the complete model.
+func (m *Model) Document() Document {
+	return newDocument(m.pods, []string{"ingress", "egress"})
+}
+
+type pod struct {
+	id        string
+	names     []string
+	namespace string
+	selector  metav1.LabelSelector
+	ingress   []target
+	egress    []target
+	// inferred describes the policy types of the policies that do not
+	// declare any, as "name: Ingress, Egress".
+	inferred []string
+	// clusterWide is set for pod groups of cluster wide policies, which
+	// select pods in every namespace.
+	clusterWide bool
+	// namespaceSelector is set for pod groups of cluster wide policies that
+	// only select pods in some namespaces.
+	namespaceSelector *metav1.LabelSelector
+	// tier is the kind of the admin network policies that select the pod
+	// group, which renderers draw before or after the pod groups of other
+	// policies. It is empty for other policies.
+	tier string
+	// selection is set once the model has been resolved against workloads.
+	selection *Selection
+}
+
+func (p *pod) Label() string {
+	b := strings.Builder{}
+	b.WriteString("Name: " + strings.Join(p.names, ", ") + "\n")
+	switch {
+	case p.namespaceSelector != nil:
+		b.WriteString("Namespaces:\n" + selectorLabel("    ", *p.namespaceSelector) + "\n")
+	case p.clusterWide:
+		b.WriteString("Namespace: all (cluster wide)\n")
+	default:
+		b.WriteString("Namespace: " + p.namespace + "\n")
+	}
+	for _, inferred := range p.inferred {
+		b.WriteString("Inferred Policy Types: " + inferred + "\n")
+	}
+	b.WriteString(selectorLabel("", p.selector))
+	if p.selection != nil {
+		b.WriteString("\n" + p.selection.Label())
+	}
+	return strings.TrimSpace(b.String()) + "\n" // ensure one trailing newline
+}
+
+type target struct {
+	id       string
+	peerId   string
+	peer     networkingv1.NetworkPolicyPeer
+	port     networkingv1.NetworkPolicyPort
+	blockAll bool
+	// allPeers is set for rules that apply to every peer, whatever their
+	// action. allowAll is only set as well when such a rule allows the
+	// traffic.
+	allPeers bool
+	allowAll bool
+	// selection is set once the model has been resolved against workloads.
+	selection *Selection
+	// entity is set for peers that are Cilium entities such as world.
+	entity string
+	// fqdn is set for peers that are DNS names or patterns.
+	fqdn string
+	// nodes is set for peers that are the nodes matching a selector.
+	nodes *metav1.LabelSelector
+	// change is set on targets of a diff model that are only present in one
+	// of the compared models.
+	change ChangeType
+	// action is set for rules with an explicit action. Network policy rules
+	// only allow traffic and have none.
+	action Action
+	// precedence is set for ordered rules and describes when the rule is
+	// evaluated, such as "order 100 rule 2".
+	precedence string
+	// mesh is set for peers that are the sources of Istio authorization
+	// policy rules.
+	mesh *IstioSource
+	// request is set for rules that only match some requests and describes
+	// them, such as "GET /api/*".
+	request string
+	// except is set for rules that exclude some of the traffic their peer
+	// and port match and describes it, such as "nets 10.0.0.0/8".
+	except []string
+}
+
+// Action is the explicit action of a rule.
+type Action string
+
+const (
+	// Allow accepts the traffic.
+	Allow Action = "Allow"
+	// Deny drops the traffic.
+	Deny Action = "Deny"
+	// Pass skips the remaining rules of the tier and leaves the traffic to
+	// the next tier.
+	Pass Action = "Pass"
+	// Log logs the traffic and continues with the next rule.
+	Log Action = "Log"
+)
+
+func (t *target) Label() string {
+	if (t.blockAll || t.allPeers) && len(t.except) == 0 {
+		return "ALL"
+	}
+	b := strings.Builder{}
+	switch {
+	case t.blockAll || t.allPeers:
+		b.WriteString("ALL")
+	case t.entity != "":
+		b.WriteString("Entity:\n    " + t.entity)
+	case t.fqdn != "":
+		b.WriteString("FQDN:\n    " + t.fqdn)
+	case t.nodes != nil:
+		b.WriteString("Nodes:\n" + selectorLabel("    ", *t.nodes))
+	case t.mesh != nil:
+		b.WriteString(t.mesh.Label())
+	default:
+		b.WriteString(peerLabel(t.peer))
+	}
+	if len(t.except) > 0 {
+		b.WriteString("\nExcept:\n    " + strings.Join(t.except, "\n    "))
+	}
+	if t.selection != nil {
+		b.WriteString("\n" + t.selection.Label())
+	}
+	// If the peer has a list of IPBlock exceptions then we need to add enough
+	// newlines so PlantUml draws the box big enough to contain all the text.
+	newlineCount := 1
+	if t.peer.IPBlock != nil {
+		newlineCount += len(t.peer.IPBlock.Except) / 2
+	}
+	return strings.TrimSpace(b.String()) + strings.Repeat("\n", newlineCount)
+}
+
+// peerStyle returns "entity" or "fqdn" for peers that renderers draw in a style
+// of their own and an empty string for other peers.
+func (t *target) peerStyle() string {
+	switch {
+	case t.entity != "":
+		return "entity"
+	case t.fqdn != "":
+		return "fqdn"
+	case t.mesh != nil:
+		return "mesh"
+	default:
+		return ""
+	}
+}
+
+// compareTarget compares the string representation of targets.  It exists only
+// to produce a stable order for benchmarking in tests.
+func compareTarget(l, r target) int {
+	return strings.Compare(l.id, r.id)
+}
+
+func convertToPodRules(policies []networkingv1.NetworkPolicy) (map[string]pod, error) {
+	pods := map[string]pod{}
+	for _, policy := range policies {
+		key := podKey(policy.Namespace, policy.Spec.PodSelector)
+		p, present := pods[key]
+		if present {
+			// This is another policy with the same selector
+			p.names = append(p.names, policy.Name)
+		}
+		if !present {
+			p = pod{
+				id:        key,
+				names:     []string{policy.Name},
+				namespace: policy.Namespace,
+				selector:  policy.Spec.PodSelector,
+			}
+		}
+		// Policies without policy types get the defaults of the API server,
+		// which are only applied when a policy is created in a cluster.
+		policyTypes := effectivePolicyTypes(policy)
+		if len(policy.Spec.PolicyTypes) == 0 {
+			types := []string{}
+			for _, t := range policyTypes {
+				types = append(types, string(t))
+			}
+			p.inferred = append(p.inferred, policy.Name+": "+strings.Join(types, ", "))
+		}
+		if slices.Contains(policyTypes, networkingv1.PolicyTypeIngress) {
+			if len(policy.Spec.Ingress) == 0 {
+				p.ingress = append(p.ingress, target{
+					id:       p.id + "_ALL_",
+					peerId:   "_ALL_PEER_INGRESS_",
+					blockAll: true,
+				})
+			} else {
+				for _, ingress := range policy.Spec.Ingress {
+					if len(ingress.From) == 0 {
+						t := target{
+							id:       targetKey(networkingv1.NetworkPolicyPeer{}, networkingv1.NetworkPolicyPort{}),
+							peerId:   "_ALL_PEER_INGRESS",
+							peer:     networkingv1.NetworkPolicyPeer{},
+							port:     networkingv1.NetworkPolicyPort{},
+							allPeers: true,
+							allowAll: true,
+						}
+						p.ingress = append(p.ingress, t)
+						continue
+					}
+					for _, peer := range ingress.From {
+						if len(ingress.Ports) > 0 {
+							for _, port := range ingress.Ports {
+								t := target{
+									id:     targetKey(peer, port),
+									peerId: peerID(peer),
+									peer:   peer,
+									port:   port,
+								}
+								p.ingress = append(p.ingress, t)
+							}
+						} else {
+							t := target{
+								id:     targetKey(peer, networkingv1.NetworkPolicyPort{}),
+								peerId: peerID(peer),
+								peer:   peer,
+								port:   networkingv1.NetworkPolicyPort{},
+							}
+							p.ingress = append(p.ingress, t)
+						}
+					}
+				}
+			}
+		}
+		if slices.Contains(policyTypes, networkingv1.PolicyTypeEgress) {
+			if len(policy.Spec.Egress) == 0 {
+				p.egress = append(p.egress, target{
+					id:       p.id + "_ALL_",
+					peerId:   "_ALL_PEER_EGRESS_",
+					blockAll: true,
+				})
+			} else {
+				for _, egress := range policy.Spec.Egress {
+					if len(egress.To) == 0 {
+						t := target{
+							id:       targetKey(networkingv1.NetworkPolicyPeer{}, networkingv1.NetworkPolicyPort{}),
+							peerId:   "_ALL_PEER_EGRESS_",
+							peer:     networkingv1.NetworkPolicyPeer{},
+							port:     networkingv1.NetworkPolicyPort{},
+							allPeers: true,
+							allowAll: true,
+						}
+						p.egress = append(p.egress, t)
+						continue
+					}
+					for _, peer := range egress.To {
+						if len(egress.Ports) > 0 {
+							for _, port := range egress.Ports {
+								t := target{
+									id:     targetKey(peer, port),
+									peerId: peerID(peer),
+									peer:   peer,
+									port:   port,
+								}
+								p.egress = append(p.egress, t)
+							}
+						} else {
+							t := target{
+								id:     targetKey(peer, networkingv1.NetworkPolicyPort{}),
+								peerId: peerID(peer),
+								peer:   peer,
+								port:   networkingv1.NetworkPolicyPort{},
+							}
+							p.egress = append(p.egress, t)
+						}
+					}
+				}
+			}
+		}
+		pods[key] = p
+	}
+	return sorted(pods), nil
+}
+
+func formatPort(port networkingv1.NetworkPolicyPort) string {
+	switch {
+	case port.Protocol != nil && port.Port != nil && port.EndPort != nil:
+		return fmt.Sprintf("%s-%d (%s)", port.Port.String(), *port.EndPort, *port.Protocol)
+	case port.Protocol != nil && port.Port != nil:
+		return fmt.Sprintf("%s (%s)", port.Port.String(), *port.Protocol)
+	case port.Port != nil && port.EndPort != nil:
+		return fmt.Sprintf("%s-%d", port.Port.String(), *port.EndPort)
+	case port.Port != nil:
+		return port.Port.String()
+	case port.Protocol != nil:
+		return fmt.Sprintf("0-65535 (%s)", *port.Protocol)
+	default:
+		return "0-65535"
+	}
+}
+
+// targetPortLabel returns the port range a target applies to.
+func targetPortLabel(t target) string {
+	if t.blockAll {
+		return "0-65535"
+	}
+	return formatPort(t.port)
+}
+
+// edgeLabel returns the label of the edge of a target: its port range,
+// preceded by the action of rules with explicit actions and by the position of
+// ordered rules, and followed by the requests of rules that only match some.
+func edgeLabel(t target) string {
+	label := targetPortLabel(t)
+	if t.request != "" {
+		label += " " + t.request
+	}
+	if t.action != "" {
+		label = strings.ToLower(string(t.action)) + " " + label
+	}
+	if t.precedence != "" {
+		label = t.precedence + ": " + label
+	}
+	return label
+}
+
+// edgeColor returns the color of the edge of a target. Edges that deny traffic
+// are red, edges that pass it to the next tier are orange, edges that only log
+// it are gray, edges that delegate it to an external authorizer are purple and
+// others are green.
+func edgeColor(t target) string {
+	switch {
+	case t.blockAll || t.action == Deny:
+		return "red"
+	case t.action == Pass:
+		return "orange"
+	case t.action == Log:
+		return "gray"
+	case t.action == Custom:
+		return "purple"
+	default:
+		return "green"
+	}
+}
+
+// LoadNamespaces returns the network policies in the given namespaces. The
+// network policies in all namespaces are returned when no namespaces are
+// given.
+func LoadNamespaces(ctx context.Context, clientset kubernetes.Interface, namespaces []string) ([]networkingv1.NetworkPolicy, error) {
+	items := []networkingv1.NetworkPolicy{}
+	if len(namespaces) == 0 {
+		list, err := clientset.NetworkingV1().NetworkPolicies("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return list.Items, nil
+
+	}
+	for _, namespace := range namespaces {
+		list, err := clientset.NetworkingV1().NetworkPolicies(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+	}
+	return items, nil
+}
+
+// LoadFiles returns the network policies in the given files. Each file may be
+// a glob, a directory or Stdin, as described by ExpandFiles, and may contain
+// multiple YAML or JSON documents. Lists, such as the output of kubectl get -o
+// yaml, are unwrapped. Other kinds and network policies of other APIs, such as
+// Calico's, are ignored. Policies are returned as written. NewModel applies
+// the policy type defaults of the API server to policies that do not declare
+// any. Documents that cannot be decoded are returned as DecodeErrors along
+// with the policies of the other documents.
+func LoadFiles(files []string) ([]networkingv1.NetworkPolicy, error) {
+	return loadFiles(files, (*Objects).NetworkPolicies)
+}
+
+// NetworkPolicies returns the network policies among the objects. Objects that
+// cannot be converted are returned as DecodeErrors along with the others.
+func (o *Objects) NetworkPolicies() ([]networkingv1.NetworkPolicy, error) {
+	items := []networkingv1.NetworkPolicy{}
+	err := o.each(func(obj *unstructured.Unstructured) error {
+		gvk := obj.GroupVersionKind()
+		if gvk.Group != networkingv1.GroupName || gvk.Kind != "NetworkPolicy" {
+			return nil
+		}
+		var policy networkingv1.NetworkPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+			return err
+		}
+		items = append(items, policy)
+		return nil
+	})
+	return items, err
+}
+
+// IgnoredPolicies describes the policies among the objects that commands
+// reading only network policies, and the given kinds, would silently drop,
+// such as Cilium or Calico policies. Each is described by its kind, Calico
+// kinds prefixed with Calico, and its namespace and name.
+func (o *Objects) IgnoredPolicies(kinds ...string) []string {
+	ignored := []string{}
+	for _, obj := range o.objects {
+		kind := policyKind(obj.Unstructured)
+		if kind == "" || kind == "NetworkPolicy" || slices.Contains(kinds, kind) {
+			continue
+		}
+		name := obj.GetName()
+		if obj.GetNamespace() != "" {
+			name = obj.GetNamespace() + "/" + name
+		}
+		ignored = append(ignored, kind+" "+name)
+	}
+	return ignored
+}
+
+// policyKind returns the kind of a policy npv reads, or an empty string for
+// other objects.
+func policyKind(obj *unstructured.Unstructured) string {
+	gvk := obj.GroupVersionKind()
+	switch {
+	case gvk.Group == networkingv1.GroupName && gvk.Kind == "NetworkPolicy":
+		return gvk.Kind
+	case gvk.Kind == CiliumNetworkPolicyKind || gvk.Kind == CiliumClusterwideNetworkPolicyKind:
+		return gvk.Kind
+	case (gvk.Group == CalicoNetworkPolicies.Group || gvk.Group == calicoCRDGroupVersion.Group) &&
+		(gvk.Kind == CalicoNetworkPolicyKind || gvk.Kind == CalicoGlobalNetworkPolicyKind):
+		return "Calico " + gvk.Kind
+	case gvk.Group == AdminNetworkPolicies.Group && (gvk.Kind == AdminNetworkPolicyKind || gvk.Kind == BaselineAdminNetworkPolicyKind):
+		return gvk.Kind
+	case gvk.Group == AuthorizationPolicies.Group && gvk.Kind == AuthorizationPolicyKind:
+		return gvk.Kind
+	}
+	return ""
+}
+
+// eachListItem calls add with the object, or with the items of a list. Items
+// of typed lists, such as NetworkPolicyList, may omit their kind, which is
+// then taken from the list.
+func eachListItem(obj *unstructured.Unstructured, add func(*unstructured.Unstructured) error) error {
+	if obj.IsList() {
+		kind, typed := strings.CutSuffix(obj.GetKind(), "List")
+		return obj.EachListItem(func(item runtime.Object) error {
+			u := item.(*unstructured.Unstructured)
+			if u.GetKind() == "" && typed && kind != "" {
+				u.SetAPIVersion(obj.GetAPIVersion())
+				u.SetKind(kind)
+			}
+			return eachListItem(u, add)
+		})
+	}
+	return add(obj)
+}
+
+func ipblockKey(ipblock networkingv1.IPBlock) string {
+	parts := []string{ipblock.CIDR}
+	parts = append(parts, ipblock.Except...)
+	return normalizePlantUMLId(strings.Join(parts, ""))
+}
+
+func ipblockLable(i networkingv1.IPBlock) string {
+	b := strings.Builder{}
+	b.WriteString("    " + i.CIDR)
+	if len(i.Except) > 0 {
+		b.WriteString("\n        except:\n            " + strings.Join(i.Except, ",\n            "))
+	}
+	return b.String()
+}
+
+func labelSelectorID(selector metav1.LabelSelector) string {
+	parts := []string{}
+	if len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0 {
+		return "_ALL_"
+	}
+	for _, k := range maputils.SortedKeys(selector.MatchLabels) {
+		parts = append(parts, k, selector.MatchLabels[k])
+	}
+	for _, e := range selector.MatchExpressions {
+		parts = append(parts, e.Key, string(e.Operator))
+		parts = append(parts, e.Values...)
+	}
+	return normalizePlantUMLId(strings.Join(parts, ""))
+}
+
+// normalizePlantUMLId converts a value into one that PlantUML accepts as part
+// of an id. Characters that are not valid in label keys and values, such as
+// those of Calico selector expressions, are replaced with their code so that
+// distinct values keep distinct ids.
+func normalizePlantUMLId(v string) string {
+	b := strings.Builder{}
+	for _, r := range v {
+		switch {
+		case r == '-' || r == ':' || r == '/':
+			b.WriteRune('_')
+		case r == '_' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9'):
+			b.WriteRune(r)
+		default:
+			b.WriteString(fmt.Sprintf("_%X_", r))
+		}
+	}
+	return b.String()
+}
+
+func peerID(peer networkingv1.NetworkPolicyPeer) string {
+	parts := []string{}
+	if peer.PodSelector != nil {
+		parts = append(parts, labelSelectorID(*peer.PodSelector))
+	}
+	if peer.NamespaceSelector != nil {
+		parts = append(parts, labelSelectorID(*peer.NamespaceSelector))
+	}
+	if peer.IPBlock != nil {
+		parts = append(parts, ipblockKey(*peer.IPBlock))
+	}
+	key := normalizePlantUMLId(strings.Join(parts, ""))
+	if key == "" {
+		return "_ALL_PEER_"
+	}
+	return key
+}
+
+func peerLabel(p networkingv1.NetworkPolicyPeer) string {
+	b := strings.Builder{}
+	if p.NamespaceSelector != nil {
+		b.WriteString("Namespace:\n" + selectorLabel("    ", *p.NamespaceSelector))
+	}
+	if p.PodSelector != nil {
+		if p.NamespaceSelector != nil {
+			b.WriteString("\n")
+		}
+		b.WriteString("Pod:\n" + selectorLabel("    ", *p.PodSelector))
+	}
+	if p.IPBlock != nil {
+		if p.NamespaceSelector != nil || p.PodSelector != nil {
+			b.WriteString("\n")
+		}
+		b.WriteString("IPBlock:\n" + ipblockLable(*p.IPBlock))
+	}
+	return b.String()
+}
+
+func podKey(namespace string, selector metav1.LabelSelector) string {
+	parts := []string{namespace, labelSelectorID(selector)}
+	return normalizePlantUMLId(strings.Join(parts, ""))
+}
+
+func selectorLabel(indent string, s metav1.LabelSelector) string {
+	if len(s.MatchLabels) == 0 && len(s.MatchExpressions) == 0 {
+		return indent + "All"
+	}
+	b := strings.Builder{}
+	if len(s.MatchLabels) > 0 {
+		b.WriteString(indent + "Match Labels:")
+		for _, k := range maputils.SortedKeys(s.MatchLabels) {
+			b.WriteString("\n" + indent + "    " + k + ": " + s.MatchLabels[k])
+		}
+	}
+	if len(s.MatchExpressions) > 0 {
+		if len(s.MatchLabels) > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "Match Expressions:")
+		for _, e := range s.MatchExpressions {
+			b.WriteString("\n" + indent + "    " + e.Key + " " + string(e.Operator) + " " + strings.Join(e.Values, ", "))
+		}
+	}
+	return b.String()
+}
+
+// sorted does not sort the map of pods. It ensures that the fields of each pod
+// are sorted so that benchmarks will be predictable.
+func sorted(pods map[string]pod) map[string]pod {
+	for _, pod := range pods {
+		slices.Sort(pod.names)
+		slices.Sort(pod.inferred)
+		slices.SortFunc(pod.ingress, compareTarget)
+		slices.SortFunc(pod.egress, compareTarget)
+	}
+	return pods
+}
+
+// orderedTargetKey returns the id of a target of an ordered rule with an
+// explicit action.
+func orderedTargetKey(peerId string, port networkingv1.NetworkPolicyPort, precedence string, action Action) string {
+	return peerTargetKey(peerId, port) + "_" + normalizePlantUMLId(strings.ReplaceAll(precedence, " ", "_")) + "_" + string(action)
+}
+
+// fqdnPeerID returns the peer id of a DNS name or pattern.
+func fqdnPeerID(name string) string {
+	return "_FQDN_" + normalizePlantUMLId(strings.ReplaceAll(name, "*", "_STAR_"))
+}
+
+func targetKey(peer networkingv1.NetworkPolicyPeer, port networkingv1.NetworkPolicyPort) string {
+	return peerTargetKey(peerID(peer), port)
+}
+
+func peerTargetKey(peerId string, port networkingv1.NetworkPolicyPort) string {
+	parts := []string{peerId}
+	if port.Protocol != nil {
+		parts = append(parts, string(*port.Protocol))
+	}
+	if port.Port != nil {
+		parts = append(parts, port.Port.String())
+	}
+	if port.EndPort != nil {
+		parts = append(parts, strconv.Itoa(int(*port.EndPort)))
+	}
+	return normalizePlantUMLId(strings.Join(parts, ""))
+}
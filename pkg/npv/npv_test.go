@@ -0,0 +1,653 @@
+package npv_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/mrxk/npv/pkg/npv"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLoadFiles(t *testing.T) {
+	policies, err := npv.LoadFiles([]string{"../../internal/visualize/testdata/multipleNamespaces.input"})
+	require.NoError(t, err)
+	require.Len(t, policies, 5)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	document := model.Document()
+	require.Equal(t, npv.SchemaVersion, document.Version)
+	require.Len(t, document.Pods, 3)
+	require.Equal(t, []string{"three", "two"}, document.Pods[1].Policies)
+	require.Len(t, document.Pods[1].Egress, 2)
+	require.Empty(t, document.Pods[1].Ingress)
+}
+
+func TestLoadFilesMixedKinds(t *testing.T) {
+	// Policies are unwrapped from lists and other kinds are ignored.
+	policies, err := npv.LoadFiles([]string{"testdata/manifests.input"})
+	require.NoError(t, err)
+	require.Len(t, policies, 2)
+	require.Equal(t, "db", policies[0].Name)
+	require.Equal(t, "web", policies[1].Name)
+	require.Len(t, policies[1].Spec.Egress, 2)
+	// Pod templates stand in for pods and namespaces are inferred.
+	workloads, err := npv.LoadWorkloadsFromFiles([]string{"testdata/manifests.input"})
+	require.NoError(t, err)
+	pods := []string{}
+	for _, pod := range workloads.Pods {
+		pods = append(pods, pod.Namespace+"/"+pod.Name)
+	}
+	require.Equal(t, []string{"shop/deployment/web", "shop/statefulset/db", "ops/cronjob/backup"}, pods)
+	namespaces := []string{}
+	for _, namespace := range workloads.Namespaces {
+		namespaces = append(namespaces, namespace.Name)
+	}
+	require.Equal(t, []string{"shop", "ops"}, namespaces)
+	require.Equal(t, "web", workloads.Namespaces[0].Labels["team"])
+}
+
+func TestLoadFilesStdin(t *testing.T) {
+	contents, err := os.ReadFile("testdata/calico.input")
+	require.NoError(t, err)
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = w.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	policies, err := npv.LoadFiles([]string{npv.Stdin})
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	// Stdin is read once however many times it is named.
+	manifests, err := npv.ReadFiles([]string{npv.Stdin, npv.Stdin}, bytes.NewReader(contents))
+	require.NoError(t, err)
+	require.Len(t, manifests, 2)
+	require.Equal(t, "<stdin>", manifests[1].Name)
+	require.Equal(t, contents, manifests[1].Contents)
+}
+
+func TestLoadFilesDecodeErrors(t *testing.T) {
+	// The documents that can be decoded are returned along with the
+	// position of those that cannot.
+	policies, err := npv.LoadFiles([]string{"testdata/malformed.input", "testdata/malformed.json"})
+	require.Len(t, policies, 3)
+	require.Equal(t, "one", policies[0].Name)
+	require.Equal(t, "four", policies[1].Name)
+	require.Equal(t, "one", policies[2].Name)
+	var decodeErrors npv.DecodeErrors
+	require.ErrorAs(t, err, &decodeErrors)
+	positions := []string{}
+	for _, e := range decodeErrors {
+		positions = append(positions, fmt.Sprintf("%s:%d:%d", e.File, e.Document, e.Line))
+	}
+	require.Equal(t, []string{
+		"testdata/malformed.input:2:17",
+		"testdata/malformed.input:3:19",
+		"testdata/malformed.json:2:4",
+	}, positions)
+	require.ErrorContains(t, err, "testdata/malformed.input: document 2, line 17: ")
+	// Errors are reported once however many loaders return them.
+	var stderr bytes.Buffer
+	check := npv.DecodeErrorHandler(&stderr, true)
+	require.NoError(t, check(err))
+	_, err = npv.LoadWorkloadsFromFiles([]string{"testdata/malformed.input"})
+	require.NoError(t, check(err))
+	require.Equal(t, 3, bytes.Count(stderr.Bytes(), []byte("warning: ")))
+	require.Equal(t, err, npv.DecodeErrorHandler(&stderr, false)(err))
+}
+
+func TestDecodeManifests(t *testing.T) {
+	// Expanded paths are read as named, even when they look like globs.
+	dir := t.TempDir()
+	contents, err := os.ReadFile("testdata/calico.input")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "policies[1].yaml"), contents, 0o644))
+	paths, err := npv.ExpandFiles([]string{dir}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "policies[1].yaml")}, paths)
+	manifests, err := npv.ReadFiles(paths, nil)
+	require.NoError(t, err)
+	objects, err := npv.DecodeManifests(manifests)
+	require.NoError(t, err)
+	policies, err := objects.NetworkPolicies()
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	calicoPolicies, err := objects.CalicoPolicies()
+	require.NoError(t, err)
+	require.Len(t, calicoPolicies, 1)
+	// Policies that commands reading only network policies would drop are
+	// described.
+	ignored := objects.IgnoredPolicies()
+	require.Len(t, ignored, 1)
+	require.True(t, strings.HasPrefix(ignored[0], "Calico NetworkPolicy "), ignored[0])
+	require.Empty(t, objects.IgnoredPolicies("Calico NetworkPolicy"))
+}
+
+func TestRenderChart(t *testing.T) {
+	manifests, err := npv.RenderChart("testdata/chart", []string{"testdata/chart.values.yaml"})
+	require.NoError(t, err)
+	// Partials and notes are not manifests.
+	names := []string{}
+	for _, manifest := range manifests {
+		names = append(names, manifest.Name)
+	}
+	require.Equal(t, []string{"shop/templates/deployment.yaml", "shop/templates/networkpolicy.yaml"}, names)
+	objects, err := npv.DecodeManifests(manifests)
+	require.NoError(t, err)
+	policies, err := objects.NetworkPolicies()
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	require.Equal(t, "default", policies[0].Namespace)
+	require.Len(t, policies[0].Spec.Ingress, 2)
+	// Objects rendered without a namespace are put in the release namespace
+	// once decoded.
+	workloads, err := objects.Workloads()
+	require.NoError(t, err)
+	require.Len(t, workloads.Pods, 1)
+	require.Empty(t, workloads.Pods[0].Namespace)
+	objects.SetDefaultNamespace(npv.ChartNamespace)
+	workloads, err = objects.Workloads()
+	require.NoError(t, err)
+	require.Len(t, workloads.Pods, 1)
+	require.Equal(t, "default", workloads.Pods[0].Namespace)
+	require.Equal(t, "release-name", workloads.Pods[0].Labels["app.kubernetes.io/instance"])
+	// Documents that cannot be decoded are reported by template path.
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "templates"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte("apiVersion: v2\nname: broken\nversion: 0.1.0\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", "policy.yaml"), []byte("kind: [\n"), 0o644))
+	manifests, err = npv.RenderChart(dir, nil)
+	require.NoError(t, err)
+	_, err = npv.DecodeManifests(manifests)
+	require.ErrorContains(t, err, "broken/templates/policy.yaml: document 1, line 1: ")
+}
+
+func TestBuildKustomization(t *testing.T) {
+	require.True(t, npv.IsKustomization("testdata/kustomize/overlays/prod"))
+	require.False(t, npv.IsKustomization("testdata/kustomize"))
+	manifest, err := npv.BuildKustomization("testdata/kustomize/overlays/prod")
+	require.NoError(t, err)
+	require.Equal(t, "testdata/kustomize/overlays/prod", manifest.Name)
+	objects, err := npv.DecodeManifests([]npv.Manifest{manifest})
+	require.NoError(t, err)
+	policies, err := objects.NetworkPolicies()
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	// The namespace and labels of the kustomization are applied, labels to
+	// selectors too, and so are its patches.
+	require.Equal(t, "prod", policies[0].Namespace)
+	require.Equal(t, map[string]string{"app": "web", "env": "prod"}, policies[0].Spec.PodSelector.MatchLabels)
+	require.Len(t, policies[0].Spec.Ingress[0].From, 2)
+	// The bases of an overlay are followed.
+	paths, err := npv.KustomizationPaths("testdata/kustomize/overlays/prod")
+	require.NoError(t, err)
+	require.Equal(t, []string{"testdata/kustomize/overlays/prod", "testdata/kustomize/base"}, paths)
+}
+
+func TestReadRevision(t *testing.T) {
+	dir := t.TempDir()
+	repository, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	worktree, err := repository.Worktree()
+	require.NoError(t, err)
+	for name, contents := range map[string]string{
+		"policies/a.yaml":   "committed",
+		"policies/notes.md": "notes",
+		"other/b.yaml":      "other",
+		".github/c.yaml":    "hidden",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644))
+		_, err = worktree.Add(name)
+		require.NoError(t, err)
+	}
+	_, err = worktree.Commit("policies", &git.CommitOptions{Author: &object.Signature{Name: "npv", When: time.Now()}})
+	require.NoError(t, err)
+	// Files are read from the revision, not from the working tree.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "policies/a.yaml"), []byte("changed"), 0o644))
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(filepath.Join(dir, "policies")))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+	manifests, err := npv.ReadRevision("HEAD", []string{".", npv.Stdin}, nil, nil, strings.NewReader("piped"))
+	require.NoError(t, err)
+	require.Equal(t, []npv.Manifest{
+		{Name: "HEAD:policies/a.yaml", Contents: []byte("committed")},
+		{Name: "<stdin>", Contents: []byte("piped")},
+	}, manifests)
+	// Files named directly are read whatever their extension.
+	manifests, err = npv.ReadRevision("HEAD", []string{"*.md", "../other"}, nil, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []npv.Manifest{
+		{Name: "HEAD:policies/notes.md", Contents: []byte("notes")},
+		{Name: "HEAD:other/b.yaml", Contents: []byte("other")},
+	}, manifests)
+	// Hidden directories are skipped and the include and exclude patterns
+	// are applied as in the working tree.
+	manifests, err = npv.ReadRevision("HEAD", []string{".."}, nil, []string{"other"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []npv.Manifest{{Name: "HEAD:policies/a.yaml", Contents: []byte("committed")}}, manifests)
+	manifests, err = npv.ReadRevision("HEAD", []string{".."}, []string{"*.md"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []npv.Manifest{{Name: "HEAD:policies/notes.md", Contents: []byte("notes")}}, manifests)
+	_, err = npv.ReadRevision("HEAD", []string{"../.."}, nil, nil, nil)
+	require.ErrorContains(t, err, "outside of the repository")
+	_, err = npv.ReadRevision("missing", []string{"."}, nil, nil, nil)
+	require.ErrorContains(t, err, "missing: reference not found")
+}
+
+func TestExpandFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"a.yaml",
+		"b.json",
+		"notes.txt",
+		"base/c.yml",
+		"base/d.input",
+		"overlays/prod/e.yaml",
+		".git/f.yaml",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+	join := func(names ...string) []string {
+		paths := []string{}
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		return paths
+	}
+	tests := map[string]struct {
+		files    []string
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		"directory": {
+			files:    []string{dir},
+			expected: join("a.yaml", "b.json", "base/c.yml", "overlays/prod/e.yaml"),
+		},
+		"stdinAndFile": {
+			files:    []string{npv.Stdin, filepath.Join(dir, "notes.txt")},
+			expected: append([]string{npv.Stdin}, join("notes.txt")...),
+		},
+		"glob": {
+			files:    []string{filepath.Join(dir, "*.yaml"), filepath.Join(dir, "base")},
+			expected: join("a.yaml", "base/c.yml"),
+		},
+		"include": {
+			files:    []string{dir},
+			include:  []string{"*.input", "overlays/*/*.yaml"},
+			expected: join("base/d.input", "overlays/prod/e.yaml"),
+		},
+		"exclude": {
+			files:    []string{dir},
+			exclude:  []string{"overlays", "*.json"},
+			expected: join("a.yaml", "base/c.yml"),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := npv.ExpandFiles(tc.files, tc.include, tc.exclude)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+	_, err := npv.ExpandFiles([]string{dir}, []string{"["}, nil)
+	require.ErrorContains(t, err, "invalid pattern")
+}
+
+func TestLoadNamespaces(t *testing.T) {
+	clientset := createFakeClientset(t, []string{"../../internal/visualize/testdata/multipleNamespaces.input"})
+	policies, err := npv.LoadNamespaces(context.Background(), clientset, []string{"two"})
+	require.NoError(t, err)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	document := model.Document()
+	require.Len(t, document.Pods, 1)
+	require.Equal(t, "twoappapp1", document.Pods[0].ID)
+	require.Len(t, document.Pods[0].Ingress, 2)
+}
+
+func TestLoadCiliumFiles(t *testing.T) {
+	policies, err := npv.LoadFiles([]string{"testdata/cilium.input"})
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	ciliumPolicies, err := npv.LoadCiliumFiles([]string{"testdata/cilium.input"})
+	require.NoError(t, err)
+	require.Len(t, ciliumPolicies, 1)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	model.AddCiliumPolicies(ciliumPolicies)
+	document := model.Document()
+	// The k8s: prefix is removed so both policies select the same pods.
+	require.Len(t, document.Pods, 1)
+	require.Equal(t, []string{"CiliumNetworkPolicy/web-egress", "web"}, document.Pods[0].Policies)
+	require.Len(t, document.Pods[0].Ingress, 1)
+	require.True(t, document.Pods[0].Ingress[0].DenyAll)
+	require.Len(t, document.Pods[0].Egress, 3)
+	require.Equal(t, npv.Deny, document.Pods[0].Egress[0].Action)
+	require.Equal(t, "kube-apiserver", document.Pods[0].Egress[1].Entity)
+	require.Equal(t, "api.example.com", document.Pods[0].Egress[2].FQDN)
+}
+
+func TestLoadCalicoFiles(t *testing.T) {
+	// The Calico NetworkPolicy is not mistaken for a network policy.
+	policies, err := npv.LoadFiles([]string{"testdata/calico.input"})
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	calicoPolicies, err := npv.LoadCalicoFiles([]string{"testdata/calico.input"})
+	require.NoError(t, err)
+	require.Len(t, calicoPolicies, 1)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	model.AddCalicoPolicies(calicoPolicies)
+	document := model.Document()
+	// The Calico selector is converted so both policies select the same pods.
+	require.Len(t, document.Pods, 1)
+	require.Equal(t, []string{"networkpolicy.projectcalico.org/web-egress", "web"}, document.Pods[0].Policies)
+	require.Len(t, document.Pods[0].Egress, 2)
+	require.Equal(t, npv.Deny, document.Pods[0].Egress[0].Action)
+	require.Equal(t, "order 10 rule 0", document.Pods[0].Egress[0].Precedence)
+	require.Equal(t, npv.Allow, document.Pods[0].Egress[1].Action)
+	require.Equal(t, "order 10 rule 1", document.Pods[0].Egress[1].Precedence)
+	require.Equal(t, &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"db", "cache"}},
+			{Key: "canary", Operator: metav1.LabelSelectorOpDoesNotExist},
+		},
+	}, document.Pods[0].Egress[1].Peer.PodSelector)
+}
+
+func TestCalicoDenyAllPeers(t *testing.T) {
+	// Rules on every peer only allow all traffic when their action is Allow.
+	model, err := npv.NewModel(nil)
+	require.NoError(t, err)
+	model.AddCalicoPolicies([]npv.CalicoNetworkPolicy{{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "projectcalico.org/v3", Kind: npv.CalicoNetworkPolicyKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: npv.CalicoPolicySpec{
+			Selector: "app == 'web'",
+			Ingress:  []npv.CalicoRule{{Action: npv.Deny}, {Action: npv.Allow}},
+		},
+	}})
+	document := model.Document()
+	require.Len(t, document.Pods, 1)
+	require.Len(t, document.Pods[0].Ingress, 2)
+	deny, allow := document.Pods[0].Ingress[0], document.Pods[0].Ingress[1]
+	if deny.Action != npv.Deny {
+		deny, allow = allow, deny
+	}
+	require.Equal(t, npv.Deny, deny.Action)
+	require.True(t, deny.AllPeers)
+	require.False(t, deny.AllowAll)
+	require.True(t, allow.AllPeers)
+	require.True(t, allow.AllowAll)
+}
+
+func TestLoadAdminFiles(t *testing.T) {
+	// Admin network policies are not mistaken for network policies.
+	policies, err := npv.LoadFiles([]string{"testdata/admin.input"})
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	adminPolicies, err := npv.LoadAdminFiles([]string{"testdata/admin.input"})
+	require.NoError(t, err)
+	require.Len(t, adminPolicies, 2)
+	require.False(t, adminPolicies[0].Baseline())
+	require.True(t, adminPolicies[1].Baseline())
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	model.AddAdminPolicies(adminPolicies)
+	document := model.Document()
+	require.Len(t, document.Pods, 3)
+	require.Equal(t, npv.AdminNetworkPolicyKind, document.Pods[0].Tier)
+	require.Equal(t, npv.BaselineAdminNetworkPolicyKind, document.Pods[1].Tier)
+	require.Equal(t, "", document.Pods[2].Tier)
+	require.Len(t, document.Pods[0].Egress, 3)
+	require.Equal(t, npv.Deny, document.Pods[0].Egress[0].Action)
+	require.Equal(t, "priority 10 rule 0", document.Pods[0].Egress[0].Precedence)
+	require.Equal(t, npv.Pass, document.Pods[0].Egress[2].Action)
+	require.Equal(t, "priority 10 rule 1", document.Pods[0].Egress[2].Precedence)
+	require.Equal(t, "baseline rule 0", document.Pods[1].Ingress[0].Precedence)
+}
+
+func TestLoadIstioFiles(t *testing.T) {
+	policies, err := npv.LoadFiles([]string{"testdata/istio.input"})
+	require.NoError(t, err)
+	istioPolicies, err := npv.LoadIstioFiles([]string{"testdata/istio.input"})
+	require.NoError(t, err)
+	require.Len(t, istioPolicies, 3)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	model.AddIstioPolicies(istioPolicies)
+	document := model.Document()
+	// Policies in the root namespace select workloads in every namespace.
+	require.Len(t, document.Pods, 2)
+	require.True(t, document.Pods[0].ClusterWide)
+	require.Equal(t, npv.Custom, document.Pods[0].Ingress[0].Action)
+	// The authorization policies share the pod group of the network policy.
+	require.Equal(t, []string{"AuthorizationPolicy/api", "AuthorizationPolicy/deny-admin", "api"}, document.Pods[1].Policies)
+	require.Len(t, document.Pods[1].Ingress, 4)
+	// Names and targets are sorted, like those of the other policies.
+	require.Equal(t, npv.Deny, document.Pods[1].Ingress[0].Action)
+	require.Equal(t, &npv.IstioSource{Principals: []string{"cluster.local/ns/frontend/sa/web"}}, document.Pods[1].Ingress[2].Mesh)
+	require.Equal(t, "GET /api/*", document.Pods[1].Ingress[2].Request)
+}
+
+func TestRendererFor(t *testing.T) {
+	for _, format := range []string{"", "plantuml", "dot", "mermaid", "json", "html", "svg"} {
+		renderer, err := npv.RendererFor(format)
+		require.NoError(t, err, format)
+		require.NotNil(t, renderer, format)
+	}
+	_, err := npv.RendererFor("png")
+	require.ErrorContains(t, err, "unsupported format: png")
+}
+
+func TestCustomRenderer(t *testing.T) {
+	policies, err := npv.LoadFiles([]string{"../../internal/visualize/testdata/multipleNamespaces.input"})
+	require.NoError(t, err)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	var renderer npv.Renderer = npv.RendererFunc(func(model *npv.Model, options npv.RenderOptions) (string, error) {
+		b := bytes.Buffer{}
+		for _, pod := range model.Document().Pods {
+			fmt.Fprintf(&b, "%s %d %d\n", pod.ID, len(pod.Ingress), len(pod.Egress))
+		}
+		return b.String(), nil
+	})
+	actual, err := renderer.Render(model, npv.RenderOptions{Ingress: true, Egress: true})
+	require.NoError(t, err)
+	require.Equal(t, "defaultappapp1 0 1\noneappapp1 0 2\ntwoappapp1 2 0\n", actual)
+}
+
+func TestSVGTruncatesRunes(t *testing.T) {
+	// Long labels are truncated without cutting multi-byte characters.
+	model, err := npv.NewModel([]networkingv1.NetworkPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": strings.Repeat("ü", 70)}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}})
+	require.NoError(t, err)
+	renderer, err := npv.RendererFor("svg")
+	require.NoError(t, err)
+	actual, err := renderer.Render(model, npv.RenderOptions{Ingress: true, Egress: true})
+	require.NoError(t, err)
+	require.True(t, utf8.ValidString(actual))
+	require.Contains(t, actual, ">    app: "+strings.Repeat("ü", 48)+"...<")
+}
+
+func TestParsePort(t *testing.T) {
+	port, err := npv.ParsePort("443")
+	require.NoError(t, err)
+	require.Equal(t, npv.Port{Number: 443}, port)
+	require.Equal(t, "443/TCP", port.String())
+	port, err = npv.ParsePort("dns/udp")
+	require.NoError(t, err)
+	require.Equal(t, npv.Port{Name: "dns", Protocol: "UDP"}, port)
+	_, err = npv.ParsePort("70000")
+	require.ErrorContains(t, err, "out of range")
+	_, err = npv.ParsePort("/TCP")
+	require.ErrorContains(t, err, "missing port")
+}
+
+func TestEvaluateNamedPort(t *testing.T) {
+	policies, err := npv.LoadFiles([]string{"testdata/namedPort.input"})
+	require.NoError(t, err)
+	from, err := npv.ParseEndpoint("default/app=client")
+	require.NoError(t, err)
+	to, err := npv.ParseEndpoint("default/app=server")
+	require.NoError(t, err)
+	verdict := npv.Evaluate(policies, from, to, npv.Port{Number: 8080, Name: "http"})
+	require.True(t, verdict.Allowed)
+	require.Equal(t, []npv.Rule{{Policy: "default/server ingress", Index: 0}}, verdict.Ingress.Rules)
+	verdict = npv.Evaluate(policies, from, to, npv.Port{Number: 8080})
+	require.False(t, verdict.Allowed)
+	require.True(t, verdict.Egress.Allowed)
+	require.False(t, verdict.Egress.Isolated)
+}
+
+func TestResolve(t *testing.T) {
+	policies, err := npv.LoadFiles([]string{"../../internal/visualize/testdata/multipleNamespaces.input"})
+	require.NoError(t, err)
+	model, err := npv.NewModel(policies)
+	require.NoError(t, err)
+	model.Resolve(&npv.Workloads{
+		Namespaces: []corev1.Namespace{
+			{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "one"}},
+		},
+		Pods: []corev1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "default", Labels: map[string]string{"app": "app1"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "default", Labels: map[string]string{"app": "app1"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "c", Namespace: "one", Labels: map[string]string{"app": "app2"}}},
+		},
+	})
+	document := model.Document()
+	require.Equal(t, &npv.Selection{Pods: []string{"default/a", "default/b"}}, document.Pods[0].Selected)
+	require.Nil(t, document.Pods[0].Egress[0].Selected)
+	require.Equal(t, []string{
+		"one/three, two: pod selector app=app1 selects no pods",
+		"two/five, four: pod selector app=app1 selects no pods",
+	}, model.Warnings())
+}
+
+func TestResolveCilium(t *testing.T) {
+	// Entity, DNS name and CIDR peers do not select pods and are not resolved.
+	ciliumPolicies, err := npv.LoadCiliumFiles([]string{"testdata/cilium.input"})
+	require.NoError(t, err)
+	model, err := npv.NewModel(nil)
+	require.NoError(t, err)
+	model.AddCiliumPolicies(ciliumPolicies)
+	model.Resolve(&npv.Workloads{
+		Namespaces: []corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "default"}}},
+		Pods: []corev1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default", Labels: map[string]string{"app": "web"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "db-1", Namespace: "default", Labels: map[string]string{"app": "db"}}},
+		},
+	})
+	document := model.Document()
+	require.Equal(t, &npv.Selection{Pods: []string{"default/web-1"}}, document.Pods[0].Selected)
+	require.Len(t, document.Pods[0].Egress, 3)
+	for _, target := range document.Pods[0].Egress {
+		require.Nil(t, target.Selected)
+	}
+	require.Empty(t, model.Warnings())
+}
+
+func TestResolveClusterWide(t *testing.T) {
+	// Cluster wide pod groups select pods in every namespace, or in those
+	// their namespace selector matches.
+	global := metav1.TypeMeta{APIVersion: "projectcalico.org/v3", Kind: npv.CalicoGlobalNetworkPolicyKind}
+	ingress := []npv.CalicoRule{{Action: npv.Allow, Source: npv.CalicoEntityRule{Selector: "app == 'client'"}}}
+	model, err := npv.NewModel(nil)
+	require.NoError(t, err)
+	model.AddCalicoPolicies([]npv.CalicoNetworkPolicy{
+		{TypeMeta: global, ObjectMeta: metav1.ObjectMeta{Name: "web"}, Spec: npv.CalicoPolicySpec{Selector: "app == 'web'", Ingress: ingress}},
+		{TypeMeta: global, ObjectMeta: metav1.ObjectMeta{Name: "shop"}, Spec: npv.CalicoPolicySpec{Selector: "app == 'web'", NamespaceSelector: "team == 'shop'", Ingress: ingress}},
+	})
+	model.Resolve(&npv.Workloads{
+		Namespaces: []corev1.Namespace{
+			{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{"team": "shop"}}},
+		},
+		Pods: []corev1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "shop", Labels: map[string]string{"app": "web"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "web-2", Namespace: "other", Labels: map[string]string{"app": "web"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "other", Labels: map[string]string{"app": "client"}}},
+		},
+	})
+	document := model.Document()
+	require.Len(t, document.Pods, 2)
+	require.Equal(t, &npv.Selection{Pods: []string{"other/web-2", "shop/web-1"}}, document.Pods[0].Selected)
+	require.Equal(t, &npv.Selection{Namespaces: []string{"shop"}, Pods: []string{"shop/web-1"}}, document.Pods[1].Selected)
+	for _, pod := range document.Pods {
+		require.Equal(t, &npv.Selection{Namespaces: []string{"other", "shop"}, Pods: []string{"other/client"}}, pod.Ingress[0].Selected)
+	}
+	require.Empty(t, model.Warnings())
+}
+
+func TestResolveCalicoExpression(t *testing.T) {
+	// Selectors that cannot be evaluated are left unresolved rather than
+	// reported as selecting nothing, and are summarized as written.
+	model, err := npv.NewModel(nil)
+	require.NoError(t, err)
+	model.AddCalicoPolicies([]npv.CalicoNetworkPolicy{{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "projectcalico.org/v3", Kind: npv.CalicoNetworkPolicyKind},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: npv.CalicoPolicySpec{
+			Selector: "app == 'web' || app == 'api'",
+			Ingress:  []npv.CalicoRule{{Action: npv.Allow, Source: npv.CalicoEntityRule{Selector: "app == 'a' || app == 'b'"}}},
+		},
+	}})
+	model.Resolve(&npv.Workloads{})
+	document := model.Document()
+	require.Len(t, document.Pods, 1)
+	require.Nil(t, document.Pods[0].Selected)
+	require.Nil(t, document.Pods[0].Ingress[0].Selected)
+	require.Empty(t, model.Warnings())
+	matrix, err := npv.NewMatrix(model, npv.RenderOptions{Ingress: true}).Render("")
+	require.NoError(t, err)
+	require.Contains(t, matrix, "default: app == 'web' || app == 'api'")
+	require.Contains(t, matrix, "from pod app == 'a' || app == 'b'")
+	require.NotContains(t, matrix, "<error>")
+}
+
+func createFakeClientset(t *testing.T, policies []string) *fake.Clientset {
+	objects := []runtime.Object{}
+	for _, policy := range policies {
+		contents, err := os.ReadFile(policy)
+		require.NoError(t, err)
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 32)
+		for {
+			var obj networkingv1.NetworkPolicy
+			err := decoder.Decode(&obj)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			objects = append(objects, &obj)
+		}
+	}
+	return fake.NewClientset(objects...)
+}
@@ -0,0 +1,160 @@
+package npv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+)
+
+func generatePodPlantUML(ids []string, pods map[string]pod, categories []string) string {
+	b := strings.Builder{}
+	for _, tier := range podTiers {
+		tierIds := tierPods(ids, pods, tier.tier, categories)
+		if tier.tier != "" && len(tierIds) == 0 {
+			continue
+		}
+		b.WriteString("frame " + tier.title + " {\n")
+		for _, id := range tierIds {
+			pod := pods[id]
+			b.WriteString(fmt.Sprintf("component \"%s\" as %s {\n", labelPlantUML(pod.Label()), id))
+			if slices.Contains(categories, "ingress") {
+				for _, t := range pod.ingress {
+					b.WriteString(fmt.Sprintf("    port \"%s\" as %s\n", labelPlantUML(edgeLabel(t)), t.id+"port"))
+				}
+			}
+			if slices.Contains(categories, "egress") {
+				if len(pod.egress) > 0 {
+					b.WriteString(fmt.Sprintf("    portout \" \" as %s\n", id+"portout"))
+				}
+			}
+			b.WriteString("}\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func generateIngressPlantUML(ids []string, pods map[string]pod) string {
+	b := strings.Builder{}
+	ingressNodes := map[string]struct{}{}
+	b.WriteString("frame Ingress {\n")
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.ingress {
+			_, present := ingressNodes[t.peerId]
+			if !present {
+				b.WriteString(
+					fmt.Sprintf("component \"%s\" as %s%s {\n    portout \" \" as %s\n}\n",
+						labelPlantUML(t.Label()),
+						t.peerId+"_i",
+						colorPlantUML(t),
+						t.peerId+"ingressportout"),
+				)
+				ingressNodes[t.peerId] = struct{}{}
+			}
+		}
+	}
+	b.WriteString("}\n")
+	// Create arrows to connect ingress to pods.
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.ingress {
+			b.WriteString(fmt.Sprintf("%s --down[%s]--> %s\n", t.peerId+"ingressportout", stylePlantUML(t), t.id+"port"))
+		}
+	}
+	return b.String()
+}
+
+func generateEgressPlantUML(ids []string, pods map[string]pod) string {
+	b := strings.Builder{}
+	egressComponents := map[string][]string{}
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.egress {
+			ports, present := egressComponents[t.peerId]
+			if !present {
+				ports = []string{fmt.Sprintf("component \"%s\" as %s%s {\n", labelPlantUML(t.Label()), t.id+"_e", colorPlantUML(t))}
+			}
+			ports = append(ports, fmt.Sprintf("    port \"%s\" as %s\n", labelPlantUML(edgeLabel(t)), t.id+"egressport"))
+			egressComponents[t.peerId] = ports
+		}
+	}
+	b.WriteString("frame Egress {\n")
+	for _, peerId := range maputils.SortedKeys(egressComponents) {
+		b.WriteString(strings.Join(egressComponents[peerId], ""))
+		b.WriteString("}\n")
+	}
+	b.WriteString("}\n")
+	// Create arrows to connect pods to egress.
+	for _, id := range ids {
+		pod := pods[id]
+		for _, t := range pod.egress {
+			b.WriteString(fmt.Sprintf("%s --down[%s]--> %s\n", id+"portout", stylePlantUML(t), t.id+"egressport"))
+		}
+	}
+	return b.String()
+}
+
+func generatePlantUML(
+	pods map[string]pod,
+	categories []string,
+	linetype string,
+) string {
+	b := strings.Builder{}
+	b.WriteString("@startuml\n")
+	b.WriteString("left to right direction\n")
+	if linetype != "" {
+		b.WriteString(fmt.Sprintf("skinparam linetype %s\n", linetype))
+	}
+	ids := maputils.SortedKeys(pods)
+	// Create the components that represent the pods.
+	b.WriteString(generatePodPlantUML(ids, pods, categories))
+	// Create components to represent all the ingres nodes
+	if slices.Contains(categories, "ingress") {
+		b.WriteString(generateIngressPlantUML(ids, pods))
+	}
+	// Create components to represent all the egress nodes
+	if slices.Contains(categories, "egress") {
+		b.WriteString(generateEgressPlantUML(ids, pods))
+	}
+	b.WriteString("@enduml\n")
+	return b.String()
+}
+
+// stylePlantUML returns the style of the arrow of a target, colored by
+// edgeColor. Added targets of a diff are blue and bold, removed targets are
+// dashed.
+func stylePlantUML(t target) string {
+	color := "#" + edgeColor(t)
+	switch t.change {
+	case Added:
+		return "#blue,bold"
+	case Removed:
+		return color + ",dashed"
+	}
+	return color
+}
+
+// colorPlantUML returns the background color of the component of a peer that
+// is drawn in a style of its own.
+func colorPlantUML(t target) string {
+	switch t.peerStyle() {
+	case "entity":
+		return " #LightBlue"
+	case "fqdn":
+		return " #Khaki"
+	case "mesh":
+		return " #Lavender"
+	default:
+		return ""
+	}
+}
+
+// labelPlantUML escapes a label for a quoted PlantUML string, left aligning
+// its lines.
+func labelPlantUML(v string) string {
+	v = strings.ReplaceAll(v, "\"", "&#34;")
+	return strings.ReplaceAll(v, "\n", "\\l")
+}
@@ -0,0 +1,380 @@
+package npv
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Endpoint is one end of a connection evaluated by Evaluate. It is either a
+// pod, identified by its namespace and labels, or an address outside the
+// cluster.
+type Endpoint struct {
+	// Namespace is the namespace of the pod. It is empty for addresses
+	// outside the cluster.
+	Namespace string
+	// Labels are the labels of the pod.
+	Labels map[string]string
+	// NamespaceLabels are the labels of the pod's namespace. The
+	// kubernetes.io/metadata.name label is implied.
+	NamespaceLabels map[string]string
+	// IP is the address of the endpoint. It is required for addresses
+	// outside the cluster and optional for pods.
+	IP net.IP
+}
+
+// IsPod reports whether the endpoint is a pod.
+func (e Endpoint) IsPod() bool {
+	return e.Namespace != ""
+}
+
+func (e Endpoint) String() string {
+	if !e.IsPod() {
+		return e.IP.String()
+	}
+	return e.Namespace + "/" + labels.FormatLabels(e.Labels)
+}
+
+func (e Endpoint) namespaceLabels() labels.Set {
+	set := labels.Set{corev1.LabelMetadataName: e.Namespace}
+	for k, v := range e.NamespaceLabels {
+		set[k] = v
+	}
+	return set
+}
+
+// ParseEndpoint parses an endpoint written as an IP address or as
+// namespace/label=value,... where the labels are optional.
+func ParseEndpoint(v string) (Endpoint, error) {
+	if ip := net.ParseIP(v); ip != nil {
+		return Endpoint{IP: ip}, nil
+	}
+	namespace, selector, found := strings.Cut(v, "/")
+	if !found || namespace == "" {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %q: expected namespace/label=value or an IP address", v)
+	}
+	set, err := labels.ConvertSelectorToLabelsMap(selector)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %q: %w", v, err)
+	}
+	return Endpoint{Namespace: namespace, Labels: set}, nil
+}
+
+// Port is the destination port of a connection evaluated by Evaluate.
+type Port struct {
+	// Number is the port number. It is zero when only Name is known.
+	Number int32
+	// Name is the name of the port in the destination pod's spec, if any.
+	// It is used to match rules that refer to named ports.
+	Name string
+	// Protocol defaults to TCP.
+	Protocol corev1.Protocol
+}
+
+func (p Port) String() string {
+	port := p.Name
+	if p.Number != 0 {
+		port = strconv.Itoa(int(p.Number))
+	}
+	return port + "/" + string(p.protocol())
+}
+
+func (p Port) protocol() corev1.Protocol {
+	if p.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return p.Protocol
+}
+
+// ParsePort parses a port written as number[/protocol] or name[/protocol].
+func ParsePort(v string) (Port, error) {
+	port, protocol, _ := strings.Cut(v, "/")
+	p := Port{Protocol: corev1.Protocol(strings.ToUpper(protocol))}
+	switch p.Protocol {
+	case "", corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+	default:
+		return Port{}, fmt.Errorf("invalid port %q: unsupported protocol %s", v, protocol)
+	}
+	if number, err := strconv.ParseInt(port, 10, 32); err == nil {
+		if number < 1 || number > 65535 {
+			return Port{}, fmt.Errorf("invalid port %q: out of range", v)
+		}
+		p.Number = int32(number)
+		return p, nil
+	}
+	if port == "" {
+		return Port{}, fmt.Errorf("invalid port %q: missing port", v)
+	}
+	p.Name = port
+	return p, nil
+}
+
+// Rule identifies a rule of a network policy.
+type Rule struct {
+	Policy string
+	Index  int
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s rule %d", r.Policy, r.Index)
+}
+
+// Decision is the outcome of evaluating one direction of a connection.
+type Decision struct {
+	// Allowed reports whether the direction allows the connection.
+	Allowed bool
+	// Isolated reports whether any policy selects the endpoint for this
+	// direction. Endpoints that are not isolated allow all traffic.
+	Isolated bool
+	// Policies are the policies that select the endpoint for this
+	// direction, as namespace/name.
+	Policies []string
+	// Rules are the rules that allow the connection.
+	Rules []Rule
+	// AdminRule is the rule of an admin network policy that allowed or
+	// denied the connection before network policies were evaluated, or of
+	// a baseline admin network policy that decided it because no network
+	// policy selects the endpoint. It is nil when no such rule matches.
+	AdminRule *Rule
+	// AdminAction is the action of AdminRule.
+	AdminAction Action
+	// Passed is the rule of an admin network policy that passed the
+	// connection on to the network policies, if any.
+	Passed *Rule
+}
+
+// Verdict is the outcome of evaluating a connection. The connection is allowed
+// only if both the egress of the source and the ingress of the destination
+// allow it.
+type Verdict struct {
+	Allowed bool
+	Egress  Decision
+	Ingress Decision
+}
+
+// Evaluate determines whether the given policies allow a connection from one
+// endpoint to another on a port using Kubernetes NetworkPolicy semantics. A
+// pod is isolated for a direction only when some policy selects it for that
+// direction, the rules of all such policies are combined, and both the
+// source's egress and the destination's ingress must allow the connection.
+func Evaluate(policies []networkingv1.NetworkPolicy, from, to Endpoint, port Port) Verdict {
+	return EvaluateWithAdminPolicies(nil, policies, from, to, port)
+}
+
+// EvaluateWithAdminPolicies is like Evaluate but also applies admin and
+// baseline admin network policies. The first matching rule of the admin
+// network policies selecting an endpoint, in order of priority, allows or
+// denies the connection before network policies are evaluated, or passes it on
+// to them. The first matching rule of a baseline admin network policy decides
+// when no network policy selects the endpoint.
+func EvaluateWithAdminPolicies(admin []AdminNetworkPolicy, policies []networkingv1.NetworkPolicy, from, to Endpoint, port Port) Verdict {
+	v := Verdict{
+		Egress:  Decision{Allowed: true, Policies: []string{}, Rules: []Rule{}},
+		Ingress: Decision{Allowed: true, Policies: []string{}, Rules: []Rule{}},
+	}
+	for _, policy := range policies {
+		name := policy.Namespace + "/" + policy.Name
+		types := effectivePolicyTypes(policy)
+		if from.IsPod() && slices.Contains(types, networkingv1.PolicyTypeEgress) && selectsPod(policy, from) {
+			v.Egress.Isolated = true
+			v.Egress.Policies = append(v.Egress.Policies, name)
+			for i, rule := range policy.Spec.Egress {
+				if peersMatch(rule.To, policy.Namespace, to) && portsMatch(rule.Ports, port) {
+					v.Egress.Rules = append(v.Egress.Rules, Rule{Policy: name + " egress", Index: i})
+				}
+			}
+		}
+		if to.IsPod() && slices.Contains(types, networkingv1.PolicyTypeIngress) && selectsPod(policy, to) {
+			v.Ingress.Isolated = true
+			v.Ingress.Policies = append(v.Ingress.Policies, name)
+			for i, rule := range policy.Spec.Ingress {
+				if peersMatch(rule.From, policy.Namespace, from) && portsMatch(rule.Ports, port) {
+					v.Ingress.Rules = append(v.Ingress.Rules, Rule{Policy: name + " ingress", Index: i})
+				}
+			}
+		}
+	}
+	for _, d := range []*Decision{&v.Egress, &v.Ingress} {
+		slices.Sort(d.Policies)
+		slices.SortFunc(d.Rules, func(l, r Rule) int {
+			if c := strings.Compare(l.Policy, r.Policy); c != 0 {
+				return c
+			}
+			return l.Index - r.Index
+		})
+	}
+	v.Egress.Allowed = !v.Egress.Isolated || len(v.Egress.Rules) > 0
+	v.Ingress.Allowed = !v.Ingress.Isolated || len(v.Ingress.Rules) > 0
+	adminPolicies, baselinePolicies := sortedAdminPolicies(admin)
+	if from.IsPod() {
+		applyAdminPolicies(&v.Egress, adminPolicies, baselinePolicies, "egress", from, to, port)
+	}
+	if to.IsPod() {
+		applyAdminPolicies(&v.Ingress, adminPolicies, baselinePolicies, "ingress", to, from, port)
+	}
+	v.Allowed = v.Egress.Allowed && v.Ingress.Allowed
+	return v
+}
+
+// applyAdminPolicies updates the decision the network policies made for a
+// direction with the admin and baseline admin network policies that select the
+// subject of the direction.
+func applyAdminPolicies(d *Decision, admin, baseline []AdminNetworkPolicy, direction string, subject, peer Endpoint, port Port) {
+	if rule, action, found := firstAdminRule(admin, direction, subject, peer, port); found {
+		if action == Pass {
+			d.Passed = &rule
+		} else {
+			d.AdminRule, d.AdminAction, d.Allowed = &rule, action, action == Allow
+			return
+		}
+	}
+	if d.Isolated {
+		return
+	}
+	if rule, action, found := firstAdminRule(baseline, direction, subject, peer, port); found && action != Pass {
+		d.AdminRule, d.AdminAction, d.Allowed = &rule, action, action == Allow
+	}
+}
+
+// firstAdminRule returns the first rule of the policies selecting the subject
+// that matches traffic with the peer on the port.
+func firstAdminRule(policies []AdminNetworkPolicy, direction string, subject, peer Endpoint, port Port) (Rule, Action, bool) {
+	for _, policy := range policies {
+		if !policy.selects(subject) {
+			continue
+		}
+		rules := policy.Spec.Ingress
+		if direction == "egress" {
+			rules = policy.Spec.Egress
+		}
+		for i, rule := range rules {
+			peers := rule.From
+			if direction == "egress" {
+				peers = rule.To
+			}
+			if rule.matches(peers, peer, port) {
+				return Rule{Policy: policy.Kind + "/" + policy.Name + " " + direction, Index: i}, rule.Action, true
+			}
+		}
+	}
+	return Rule{}, "", false
+}
+
+// effectivePolicyTypes returns the policy types of a policy, applying the
+// defaults of the API server when none are declared.
+func effectivePolicyTypes(policy networkingv1.NetworkPolicy) []networkingv1.PolicyType {
+	if len(policy.Spec.PolicyTypes) > 0 {
+		return policy.Spec.PolicyTypes
+	}
+	types := []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	if len(policy.Spec.Egress) > 0 {
+		types = append(types, networkingv1.PolicyTypeEgress)
+	}
+	return types
+}
+
+func selectsPod(policy networkingv1.NetworkPolicy, e Endpoint) bool {
+	return policy.Namespace == e.Namespace && selectorMatches(policy.Spec.PodSelector, e.Labels)
+}
+
+func selectorMatches(s metav1.LabelSelector, set map[string]string) bool {
+	selector, err := metav1.LabelSelectorAsSelector(&s)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(set))
+}
+
+// peersMatch reports whether any of the peers of a rule in a policy in the
+// given namespace matches the endpoint. An empty list of peers matches every
+// endpoint.
+func peersMatch(peers []networkingv1.NetworkPolicyPeer, namespace string, e Endpoint) bool {
+	if len(peers) == 0 {
+		return true
+	}
+	for _, peer := range peers {
+		if peerMatches(peer, namespace, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerMatches(peer networkingv1.NetworkPolicyPeer, namespace string, e Endpoint) bool {
+	if peer.IPBlock != nil {
+		return ipBlockMatches(*peer.IPBlock, e.IP)
+	}
+	if !e.IsPod() {
+		return false
+	}
+	if peer.NamespaceSelector == nil {
+		if e.Namespace != namespace {
+			return false
+		}
+	} else if !selectorMatches(*peer.NamespaceSelector, e.namespaceLabels()) {
+		return false
+	}
+	if peer.PodSelector == nil {
+		return true
+	}
+	return selectorMatches(*peer.PodSelector, e.Labels)
+}
+
+func ipBlockMatches(ipblock networkingv1.IPBlock, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	_, cidr, err := net.ParseCIDR(ipblock.CIDR)
+	if err != nil || !cidr.Contains(ip) {
+		return false
+	}
+	for _, except := range ipblock.Except {
+		_, cidr, err := net.ParseCIDR(except)
+		if err == nil && cidr.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// portsMatch reports whether any of the ports of a rule matches the port. An
+// empty list of ports matches every port.
+func portsMatch(ports []networkingv1.NetworkPolicyPort, port Port) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, p := range ports {
+		if portMatches(p, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func portMatches(p networkingv1.NetworkPolicyPort, port Port) bool {
+	protocol := corev1.ProtocolTCP
+	if p.Protocol != nil {
+		protocol = *p.Protocol
+	}
+	if protocol != port.protocol() {
+		return false
+	}
+	switch {
+	case p.Port == nil:
+		return true
+	case p.Port.Type == intstr.String:
+		return port.Name != "" && p.Port.StrVal == port.Name
+	case p.EndPort != nil:
+		return port.Number >= p.Port.IntVal && port.Number <= *p.EndPort
+	default:
+		return port.Number == p.Port.IntVal
+	}
+}
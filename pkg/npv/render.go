@@ -0,0 +1,121 @@
+package npv
+
+import (
+	"fmt"
+	"slices"
+)
+
+// RenderOptions controls which parts of a Model are rendered.
+type RenderOptions struct {
+	// Ingress includes ingress rules.
+	Ingress bool
+	// Egress includes egress rules.
+	Egress bool
+	// Linetype is the PlantUML linetype skinparam (polyline or ortho). It is
+	// ignored by other renderers.
+	Linetype string
+}
+
+// categories returns the rule categories selected by the options.
+func (o RenderOptions) categories() []string {
+	categories := []string{}
+	if o.Ingress {
+		categories = append(categories, "ingress")
+	}
+	if o.Egress {
+		categories = append(categories, "egress")
+	}
+	return categories
+}
+
+// podTiers lists the tiers of pod groups in order of evaluation. Diagrams
+// draw the pod groups of each tier in a frame of its own.
+var podTiers = []struct {
+	// tier is the tier of the pod groups.
+	tier string
+	// id identifies the frame.
+	id string
+	// title is the title of the frame.
+	title string
+}{
+	{tier: AdminNetworkPolicyKind, id: "admin", title: "AdminNetworkPolicies"},
+	{tier: "", id: "pods", title: "Pods"},
+	{tier: BaselineAdminNetworkPolicyKind, id: "baseline", title: "BaselineAdminNetworkPolicies"},
+}
+
+// tierPods returns the ids of the pod groups of a tier that have rules in the
+// given categories.
+func tierPods(ids []string, pods map[string]pod, tier string, categories []string) []string {
+	result := []string{}
+	for _, id := range ids {
+		pod := pods[id]
+		if pod.tier != tier {
+			continue
+		}
+		if (slices.Contains(categories, "ingress") && len(pod.ingress) > 0) ||
+			(slices.Contains(categories, "egress") && len(pod.egress) > 0) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// idsByTier orders the ids of pod groups by tier.
+func idsByTier(ids []string, pods map[string]pod) []string {
+	result := []string{}
+	for _, tier := range podTiers {
+		for _, id := range ids {
+			if pods[id].tier == tier.tier {
+				result = append(result, id)
+			}
+		}
+	}
+	return result
+}
+
+// Renderer turns a Model into text such as a diagram. Renderers outside this
+// package can inspect the model through Model.Document.
+type Renderer interface {
+	Render(model *Model, options RenderOptions) (string, error)
+}
+
+// RendererFunc adapts a function to the Renderer interface.
+type RendererFunc func(model *Model, options RenderOptions) (string, error)
+
+func (f RendererFunc) Render(model *Model, options RenderOptions) (string, error) {
+	return f(model, options)
+}
+
+var renderers = map[string]Renderer{
+	"plantuml": RendererFunc(func(model *Model, options RenderOptions) (string, error) {
+		return generatePlantUML(model.pods, options.categories(), options.Linetype), nil
+	}),
+	"dot": RendererFunc(func(model *Model, options RenderOptions) (string, error) {
+		return generateDOT(model.pods, options.categories()), nil
+	}),
+	"mermaid": RendererFunc(func(model *Model, options RenderOptions) (string, error) {
+		return generateMermaid(model.pods, options.categories()), nil
+	}),
+	"json": RendererFunc(func(model *Model, options RenderOptions) (string, error) {
+		return generateJSON(model.pods, options.categories())
+	}),
+	"svg": RendererFunc(func(model *Model, options RenderOptions) (string, error) {
+		return generateSVG(model.pods, options.categories()), nil
+	}),
+	"html": RendererFunc(func(model *Model, options RenderOptions) (string, error) {
+		return generateHTML(model.pods, options.categories())
+	}),
+}
+
+// RendererFor returns the renderer registered for the given format. An empty
+// format selects PlantUML.
+func RendererFor(format string) (Renderer, error) {
+	if format == "" {
+		format = "plantuml"
+	}
+	renderer, present := renderers[format]
+	if !present {
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+	return renderer, nil
+}
@@ -0,0 +1,307 @@
+package npv
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxSelectionLines limits the number of pods or namespaces listed in a label.
+const maxSelectionLines = 10
+
+// Workloads are the pods and namespaces that selectors are resolved against.
+type Workloads struct {
+	Pods       []corev1.Pod
+	Namespaces []corev1.Namespace
+}
+
+// LoadWorkloads returns the pods and namespaces in the cluster.
+func LoadWorkloads(ctx context.Context, clientset kubernetes.Interface) (*Workloads, error) {
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &Workloads{Pods: pods.Items, Namespaces: namespaces.Items}, nil
+}
+
+// templateFields are the fields holding the pod template of the kinds of
+// workload controllers.
+var templateFields = map[string][]string{
+	"Deployment":            {"spec", "template"},
+	"StatefulSet":           {"spec", "template"},
+	"DaemonSet":             {"spec", "template"},
+	"ReplicaSet":            {"spec", "template"},
+	"ReplicationController": {"spec", "template"},
+	"Job":                   {"spec", "template"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template"},
+}
+
+// LoadWorkloadsFromFiles returns the pods and namespaces in the given files,
+// such as the output of kubectl get pods,namespaces -A -o yaml. Each file may
+// be a glob, a directory or Stdin and may contain multiple YAML or JSON
+// documents. Lists are unwrapped and other kinds are ignored. When the files
+// contain no pods, as with manifests that have not been deployed, the pod
+// templates of workload controllers such as Deployments stand in for their
+// pods. Namespaces that objects are in but that have no Namespace document
+// are added with their name only. Documents that cannot be decoded are
+// returned as DecodeErrors, as with LoadFiles.
+func LoadWorkloadsFromFiles(files []string) (*Workloads, error) {
+	return loadFiles(files, (*Objects).Workloads)
+}
+
+// Workloads returns the pods and namespaces among the objects, as
+// LoadWorkloadsFromFiles does. Objects that cannot be converted are returned
+// as DecodeErrors along with the others.
+func (o *Objects) Workloads() (*Workloads, error) {
+	w := &Workloads{}
+	templates := []corev1.Pod{}
+	namespaces := []string{}
+	err := o.each(func(obj *unstructured.Unstructured) error {
+		if obj.GetNamespace() != "" && !slices.Contains(namespaces, obj.GetNamespace()) {
+			namespaces = append(namespaces, obj.GetNamespace())
+		}
+		if fields, present := templateFields[obj.GetKind()]; present {
+			labels, _, err := unstructured.NestedStringMap(obj.Object, append(slices.Clone(fields), "metadata", "labels")...)
+			if err != nil {
+				return err
+			}
+			templates = append(templates, corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:      strings.ToLower(obj.GetKind()) + "/" + obj.GetName(),
+				Namespace: obj.GetNamespace(),
+				Labels:    labels,
+			}})
+			return nil
+		}
+		return w.add(obj)
+	})
+	if len(w.Pods) == 0 {
+		w.Pods = templates
+	}
+	for _, name := range namespaces {
+		if !slices.ContainsFunc(w.Namespaces, func(n corev1.Namespace) bool { return n.Name == name }) {
+			w.Namespaces = append(w.Namespaces, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+	}
+	return w, err
+}
+
+func (w *Workloads) add(obj *unstructured.Unstructured) error {
+	switch obj.GetKind() {
+	case "Pod":
+		var pod corev1.Pod
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &pod); err != nil {
+			return err
+		}
+		w.Pods = append(w.Pods, pod)
+	case "Namespace":
+		var namespace corev1.Namespace
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &namespace); err != nil {
+			return err
+		}
+		w.Namespaces = append(w.Namespaces, namespace)
+	}
+	return nil
+}
+
+// Selection is the set of namespaces and pods a selector resolved to.
+type Selection struct {
+	// Namespaces holds the sorted names of the selected namespaces. It is
+	// only set for peers with a namespace selector.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Pods holds the sorted namespace/name of the selected pods.
+	Pods []string `json:"pods"`
+}
+
+// Label describes the selection. Selections that match nothing are flagged
+// with a warning.
+func (s *Selection) Label() string {
+	b := strings.Builder{}
+	if s.Namespaces != nil {
+		b.WriteString(selectionLabel("namespace", s.Namespaces))
+	}
+	b.WriteString(selectionLabel("pod", s.Pods))
+	return b.String()
+}
+
+func selectionLabel(kind string, names []string) string {
+	if len(names) == 0 {
+		return "WARNING: selects no " + kind + "s\n"
+	}
+	if len(names) > 1 {
+		kind += "s"
+	}
+	b := strings.Builder{}
+	b.WriteString("Selects " + strconv.Itoa(len(names)) + " " + kind + ":\n")
+	for i, name := range names {
+		if i == maxSelectionLines {
+			b.WriteString(fmt.Sprintf("    ... and %d more\n", len(names)-maxSelectionLines))
+			break
+		}
+		b.WriteString("    " + name + "\n")
+	}
+	return b.String()
+}
+
+// Resolve annotates the pod groups and peers of the model with the pods and
+// namespaces their selectors match.
+func (m *Model) Resolve(w *Workloads) {
+	namespaceLabels := map[string]labels.Set{}
+	for _, namespace := range w.Namespaces {
+		set := labels.Set{corev1.LabelMetadataName: namespace.Name}
+		for k, v := range namespace.Labels {
+			set[k] = v
+		}
+		namespaceLabels[namespace.Name] = set
+	}
+	pods := []corev1.Pod{}
+	for _, pod := range w.Pods {
+		// Completed pods are not affected by network policies.
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	all := allNamespaces(pods, namespaceLabels)
+	for id, p := range m.pods {
+		// Pod groups of cluster wide policies select pods in every namespace,
+		// or in those their namespace selector matches, and the peers of their
+		// rules without a namespace selector select pods in every namespace.
+		namespaces := []string{p.namespace}
+		if p.clusterWide {
+			namespaces = all
+		}
+		// Groups with a selector that cannot be evaluated, such as a Calico
+		// expression with ||, are left unresolved.
+		p.selection = nil
+		if resolvable(p.selector) && (p.namespaceSelector == nil || resolvable(*p.namespaceSelector)) {
+			selection := &Selection{}
+			podNamespaces := namespaces
+			if p.clusterWide && p.namespaceSelector != nil {
+				selection.Namespaces = selectNamespaces(namespaceLabels, *p.namespaceSelector)
+				podNamespaces = selection.Namespaces
+			}
+			selection.Pods = selectPods(pods, podNamespaces, p.selector)
+			p.selection = selection
+		}
+		resolveTargets(p.ingress, namespaces, pods, namespaceLabels)
+		resolveTargets(p.egress, namespaces, pods, namespaceLabels)
+		m.pods[id] = p
+	}
+}
+
+// allNamespaces returns the sorted names of the namespaces of the workloads,
+// including those that only pods are in.
+func allNamespaces(pods []corev1.Pod, namespaceLabels map[string]labels.Set) []string {
+	namespaces := maputils.SortedKeys(namespaceLabels)
+	for _, pod := range pods {
+		if !slices.Contains(namespaces, pod.Namespace) {
+			namespaces = append(namespaces, pod.Namespace)
+		}
+	}
+	slices.Sort(namespaces)
+	return namespaces
+}
+
+// Warnings returns a description of every selector in a resolved model that
+// matches nothing.
+func (m *Model) Warnings() []string {
+	warnings := []string{}
+	for _, id := range maputils.SortedKeys(m.pods) {
+		p := m.pods[id]
+		policies := p.namespace + "/" + strings.Join(p.names, ", ")
+		if p.clusterWide {
+			policies = strings.Join(p.names, ", ")
+		}
+		if p.selection != nil && len(p.selection.Pods) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: pod selector %s selects no pods", policies, selectorSummary(p.selector)))
+		}
+		for _, t := range append(slices.Clone(p.ingress), p.egress...) {
+			if t.selection == nil {
+				continue
+			}
+			if t.selection.Namespaces != nil && len(t.selection.Namespaces) == 0 {
+				warnings = append(warnings, fmt.Sprintf("%s: peer %s selects no namespaces", policies, peerSummary(t.peer)))
+			} else if len(t.selection.Pods) == 0 {
+				warnings = append(warnings, fmt.Sprintf("%s: peer %s selects no pods", policies, peerSummary(t.peer)))
+			}
+		}
+	}
+	return slices.Compact(warnings)
+}
+
+// resolveTargets resolves the peers of the targets. Peers without a namespace
+// selector select pods in the given namespaces.
+func resolveTargets(targets []target, namespaces []string, pods []corev1.Pod, namespaceLabels map[string]labels.Set) {
+	for i, t := range targets {
+		// Only peers that select pods are resolved.
+		if t.blockAll || t.allPeers || t.peer.IPBlock != nil || t.mesh != nil || t.entity != "" || t.fqdn != "" || t.nodes != nil {
+			continue
+		}
+		// Nor are peers with a selector that cannot be evaluated.
+		if (t.peer.PodSelector != nil && !resolvable(*t.peer.PodSelector)) || (t.peer.NamespaceSelector != nil && !resolvable(*t.peer.NamespaceSelector)) {
+			continue
+		}
+		selection := &Selection{}
+		peerNamespaces := namespaces
+		if t.peer.NamespaceSelector != nil {
+			selection.Namespaces = selectNamespaces(namespaceLabels, *t.peer.NamespaceSelector)
+			peerNamespaces = selection.Namespaces
+		}
+		podSelector := metav1.LabelSelector{}
+		if t.peer.PodSelector != nil {
+			podSelector = *t.peer.PodSelector
+		}
+		selection.Pods = selectPods(pods, peerNamespaces, podSelector)
+		targets[i].selection = selection
+	}
+}
+
+// resolvable reports whether a label selector can be evaluated. Calico
+// expressions that are not a conjunction of simple terms cannot.
+func resolvable(s metav1.LabelSelector) bool {
+	_, err := metav1.LabelSelectorAsSelector(&s)
+	return err == nil
+}
+
+func selectNamespaces(namespaceLabels map[string]labels.Set, s metav1.LabelSelector) []string {
+	selector, err := metav1.LabelSelectorAsSelector(&s)
+	if err != nil {
+		return []string{}
+	}
+	selected := []string{}
+	for _, name := range maputils.SortedKeys(namespaceLabels) {
+		if selector.Matches(namespaceLabels[name]) {
+			selected = append(selected, name)
+		}
+	}
+	return selected
+}
+
+func selectPods(pods []corev1.Pod, namespaces []string, s metav1.LabelSelector) []string {
+	selector, err := metav1.LabelSelectorAsSelector(&s)
+	if err != nil {
+		return []string{}
+	}
+	selected := []string{}
+	for _, pod := range pods {
+		if slices.Contains(namespaces, pod.Namespace) && selector.Matches(labels.Set(pod.Labels)) {
+			selected = append(selected, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	slices.Sort(selected)
+	return selected
+}
@@ -0,0 +1,286 @@
+package npv
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+
+	"github.com/mrxk/npv/internal/maputils"
+)
+
+// The SVG layout uses a monospaced font so text can be measured without
+// access to font metrics.
+const (
+	svgCharWidth     = 7.2
+	svgLineHeight    = 15
+	svgNodePadding   = 8
+	svgNodeGap       = 16
+	svgColumnGap     = 220
+	svgFramePadding  = 16
+	svgFrameTitle    = 24
+	svgMargin        = 20
+	svgMaxEdgePorts  = 3
+	svgMinNodeWidth  = 80
+	svgMaxLabelChars = 60
+)
+
+type svgNode struct {
+	id     string
+	fill   string
+	lines  []string
+	x, y   float64
+	width  float64
+	height float64
+}
+
+type svgEdge struct {
+	from, to string
+	ports    []string
+	deny     bool
+	color    string
+}
+
+type svgColumn struct {
+	title string
+	nodes []*svgNode
+	x, y  float64
+	width float64
+}
+
+func (c *svgColumn) height() float64 {
+	h := 0.0
+	for _, n := range c.nodes {
+		h += n.height + svgNodeGap
+	}
+	if len(c.nodes) > 0 {
+		h -= svgNodeGap
+	}
+	return h
+}
+
+// newSVGTargetNode returns the node of a peer. Peers that are drawn in a style
+// of their own get a different fill.
+func newSVGTargetNode(id string, t target) *svgNode {
+	n := newSVGNode(id, t.Label())
+	switch t.peerStyle() {
+	case "entity":
+		n.fill = "#add8e6"
+	case "fqdn":
+		n.fill = "#f0e68c"
+	case "mesh":
+		n.fill = "#e6e6fa"
+	}
+	return n
+}
+
+func newSVGNode(id, label string) *svgNode {
+	lines := strings.Split(strings.TrimRight(label, "\n"), "\n")
+	width := 0
+	for i, line := range lines {
+		// Lines are truncated on runes so that multi-byte characters are
+		// not cut.
+		runes := []rune(line)
+		if len(runes) > svgMaxLabelChars {
+			runes = append(runes[:svgMaxLabelChars-3], []rune("...")...)
+			lines[i] = string(runes)
+		}
+		width = max(width, len(runes))
+	}
+	return &svgNode{
+		id:     id,
+		fill:   "#fefece",
+		lines:  lines,
+		width:  max(float64(width)*svgCharWidth+2*svgNodePadding, svgMinNodeWidth),
+		height: float64(len(lines))*svgLineHeight + 2*svgNodePadding,
+	}
+}
+
+// orderByBarycenter sorts peer nodes by the average position of the pods they
+// are connected to. This keeps edges short and reduces crossings.
+func orderByBarycenter(nodes []*svgNode, edges []svgEdge, podIndex map[string]int) {
+	centers := map[string]float64{}
+	for _, n := range nodes {
+		sum, count := 0.0, 0.0
+		for _, e := range edges {
+			if e.from == n.id {
+				sum += float64(podIndex[e.to])
+				count++
+			}
+			if e.to == n.id {
+				sum += float64(podIndex[e.from])
+				count++
+			}
+		}
+		if count > 0 {
+			centers[n.id] = sum / count
+		}
+	}
+	slices.SortStableFunc(nodes, func(l, r *svgNode) int {
+		switch {
+		case centers[l.id] < centers[r.id]:
+			return -1
+		case centers[l.id] > centers[r.id]:
+			return 1
+		default:
+			return 0
+		}
+	})
+}
+
+// addSVGEdge adds a target to the edges, merging targets that connect the same
+// nodes so that each pair of nodes is joined by at most one allow and one deny
+// edge.
+func addSVGEdge(edges []svgEdge, from, to string, t target) []svgEdge {
+	port := edgeLabel(t)
+	color := edgeColor(t)
+	for i := range edges {
+		if edges[i].from == from && edges[i].to == to && edges[i].deny == t.blockAll && edges[i].color == color {
+			if !slices.Contains(edges[i].ports, port) {
+				edges[i].ports = append(edges[i].ports, port)
+			}
+			return edges
+		}
+	}
+	return append(edges, svgEdge{from: from, to: to, ports: []string{port}, deny: t.blockAll, color: color})
+}
+
+func layoutSVG(
+	pods map[string]pod,
+	categories []string,
+) ([]*svgColumn, []svgEdge) {
+	ingress := &svgColumn{title: "Ingress"}
+	podColumn := &svgColumn{title: "Pods"}
+	egress := &svgColumn{title: "Egress"}
+	ingressNodes := map[string]*svgNode{}
+	egressNodes := map[string]*svgNode{}
+	edges := []svgEdge{}
+	podIndex := map[string]int{}
+	for _, id := range idsByTier(maputils.SortedKeys(pods), pods) {
+		pod := pods[id]
+		podId := "p_" + id
+		included := false
+		if slices.Contains(categories, "ingress") {
+			for _, t := range pod.ingress {
+				peerId := "i_" + t.peerId
+				if _, present := ingressNodes[peerId]; !present {
+					ingressNodes[peerId] = newSVGTargetNode(peerId, t)
+				}
+				edges = addSVGEdge(edges, peerId, podId, t)
+				included = true
+			}
+		}
+		if slices.Contains(categories, "egress") {
+			for _, t := range pod.egress {
+				peerId := "e_" + t.peerId
+				if _, present := egressNodes[peerId]; !present {
+					egressNodes[peerId] = newSVGTargetNode(peerId, t)
+				}
+				edges = addSVGEdge(edges, podId, peerId, t)
+				included = true
+			}
+		}
+		if included {
+			podIndex[podId] = len(podColumn.nodes)
+			podColumn.nodes = append(podColumn.nodes, newSVGNode(podId, pod.Label()))
+		}
+	}
+	for _, peerId := range maputils.SortedKeys(ingressNodes) {
+		ingress.nodes = append(ingress.nodes, ingressNodes[peerId])
+	}
+	for _, peerId := range maputils.SortedKeys(egressNodes) {
+		egress.nodes = append(egress.nodes, egressNodes[peerId])
+	}
+	orderByBarycenter(ingress.nodes, edges, podIndex)
+	orderByBarycenter(egress.nodes, edges, podIndex)
+
+	columns := []*svgColumn{}
+	if slices.Contains(categories, "ingress") {
+		columns = append(columns, ingress)
+	}
+	columns = append(columns, podColumn)
+	if slices.Contains(categories, "egress") {
+		columns = append(columns, egress)
+	}
+	tallest := 0.0
+	for _, c := range columns {
+		tallest = max(tallest, c.height())
+	}
+	x := float64(svgMargin)
+	for _, c := range columns {
+		c.width = svgMinNodeWidth
+		for _, n := range c.nodes {
+			c.width = max(c.width, n.width)
+		}
+		c.x = x
+		c.y = svgMargin
+		// Center each column vertically against the tallest column.
+		y := c.y + svgFrameTitle + svgFramePadding + (tallest-c.height())/2
+		for _, n := range c.nodes {
+			n.x = c.x + svgFramePadding + (c.width-n.width)/2
+			n.y = y
+			y += n.height + svgNodeGap
+		}
+		x += c.width + 2*svgFramePadding + svgColumnGap
+	}
+	return columns, edges
+}
+
+func generateSVG(
+	pods map[string]pod,
+	categories []string,
+) string {
+	columns, edges := layoutSVG(pods, categories)
+	nodes := map[string]*svgNode{}
+	width, height := 0.0, 0.0
+	for _, c := range columns {
+		for _, n := range c.nodes {
+			nodes[n.id] = n
+		}
+		width = c.x + c.width + 2*svgFramePadding + svgMargin
+		height = max(height, c.height())
+	}
+	frameHeight := height + svgFrameTitle + 2*svgFramePadding
+	height = frameHeight + 2*svgMargin
+
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" viewBox=\"0 0 %.0f %.0f\" font-family=\"monospace\" font-size=\"12\">\n", width, height, width, height))
+	b.WriteString("<rect width=\"100%\" height=\"100%\" fill=\"white\"/>\n")
+	// Draw the frames and nodes.
+	for _, c := range columns {
+		b.WriteString(fmt.Sprintf("<g class=\"frame\">\n<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"none\" stroke=\"#888\"/>\n", c.x, c.y, c.width+2*svgFramePadding, frameHeight))
+		b.WriteString(fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" font-weight=\"bold\">%s</text>\n</g>\n", c.x+svgFramePadding, c.y+svgFrameTitle-6, c.title))
+		for _, n := range c.nodes {
+			b.WriteString(fmt.Sprintf("<g class=\"node\" id=\"%s\">\n", html.EscapeString(n.id)))
+			b.WriteString(fmt.Sprintf("<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" rx=\"4\" fill=\"%s\" stroke=\"#a80036\"/>\n", n.x, n.y, n.width, n.height, n.fill))
+			b.WriteString(fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" xml:space=\"preserve\">", n.x+svgNodePadding, n.y+svgNodePadding))
+			for _, line := range n.lines {
+				b.WriteString(fmt.Sprintf("<tspan x=\"%.1f\" dy=\"%d\">%s</tspan>", n.x+svgNodePadding, svgLineHeight, html.EscapeString(line)))
+			}
+			b.WriteString("</text>\n</g>\n")
+		}
+	}
+	// Draw the edges.
+	for _, e := range edges {
+		from, to := nodes[e.from], nodes[e.to]
+		x1, y1 := from.x+from.width, from.y+from.height/2
+		x2, y2 := to.x, to.y+to.height/2
+		mid := (x1 + x2) / 2
+		color, dash := e.color, ""
+		if e.deny {
+			dash = " stroke-dasharray=\"6,4\""
+		}
+		label := strings.Join(e.ports, ", ")
+		if len(e.ports) > svgMaxEdgePorts {
+			label = fmt.Sprintf("%s +%d", strings.Join(e.ports[:svgMaxEdgePorts], ", "), len(e.ports)-svgMaxEdgePorts)
+		}
+		b.WriteString("<g class=\"edge\">\n")
+		b.WriteString(fmt.Sprintf("<title>%s</title>\n", html.EscapeString(strings.Join(e.ports, ", "))))
+		b.WriteString(fmt.Sprintf("<path d=\"M %.1f %.1f C %.1f %.1f, %.1f %.1f, %.1f %.1f\" fill=\"none\" stroke=\"%s\"%s/>\n", x1, y1, mid, y1, mid, y2, x2, y2, color, dash))
+		b.WriteString(fmt.Sprintf("<polygon points=\"%.1f,%.1f %.1f,%.1f %.1f,%.1f\" fill=\"%s\"/>\n", x2, y2, x2-8, y2-4, x2-8, y2+4, color))
+		b.WriteString(fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"middle\" fill=\"%s\">%s</text>\n", mid, (y1+y2)/2-4, color, html.EscapeString(label)))
+		b.WriteString("</g>\n")
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}